@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/rumlang/rum/format"
+)
+
+// formatMain implements the fmt subcommand, which formats Rum source files
+// like gofmt: rum fmt [-w|-d|-l] [path...]. It returns the exit code.
+func formatMain(args []string) int {
+	flags := flag.NewFlagSet("fmt", flag.ExitOnError)
+	write := flags.Bool("w", false, "write the result to the source files instead of the standard output")
+	diff := flags.Bool("d", false, "display the differences instead of the formatted source")
+	list := flags.Bool("l", false, "list the files whose formatting differs")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: rum fmt [-w|-d|-l] [path ...]\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	f := &formatter{write: *write, diff: *diff, list: *list}
+	if flags.NArg() == 0 {
+		if *write {
+			fmt.Fprintf(os.Stderr, "can not use -w with the standard input\n")
+			return 2
+		}
+		f.file("<standard input>", os.Stdin, nil)
+		return f.exitCode
+	}
+
+	for _, path := range flags.Args() {
+		info, err := os.Stat(path)
+		if err != nil {
+			f.error(err)
+			continue
+		}
+		if !info.IsDir() {
+			f.path(path, info)
+			continue
+		}
+		err = filepath.Walk(path, func(path string, info os.FileInfo, err error) error {
+			if err == nil && !info.IsDir() && strings.HasSuffix(path, ".rum") {
+				f.path(path, info)
+			}
+			return err
+		})
+		if err != nil {
+			f.error(err)
+		}
+	}
+	return f.exitCode
+}
+
+// formatter formats files according to the flags of the fmt subcommand.
+type formatter struct {
+	write, diff, list bool
+	exitCode          int
+}
+
+func (f *formatter) error(err error) {
+	fmt.Fprintln(os.Stderr, err)
+	f.exitCode = 2
+}
+
+func (f *formatter) path(path string, info os.FileInfo) {
+	file, err := os.Open(path)
+	if err != nil {
+		f.error(err)
+		return
+	}
+	defer file.Close()
+	f.file(path, file, info)
+}
+
+// file formats the content of r, named name, from a file described by info
+// if it is not the standard input.
+func (f *formatter) file(name string, r io.Reader, info os.FileInfo) {
+	src, err := ioutil.ReadAll(r)
+	if err != nil {
+		f.error(err)
+		return
+	}
+	res, err := format.Source(src)
+	if err != nil {
+		f.error(fmt.Errorf("%s: %v", name, err))
+		return
+	}
+
+	if !f.write && !f.diff && !f.list {
+		os.Stdout.Write(res)
+		return
+	}
+	if bytes.Equal(src, res) {
+		return
+	}
+	if f.list {
+		fmt.Println(name)
+	}
+	if f.write {
+		if err := ioutil.WriteFile(name, res, info.Mode().Perm()); err != nil {
+			f.error(err)
+			return
+		}
+	}
+	if f.diff {
+		d, err := diffSources(name, src, res)
+		if err != nil {
+			f.error(fmt.Errorf("computing diff: %v", err))
+			return
+		}
+		fmt.Printf("diff -u %s.orig %s\n", name, name)
+		os.Stdout.Write(d)
+	}
+}
+
+// diffSources returns the unified diff of the sources a and b of file name,
+// computed by the diff command.
+func diffSources(name string, a, b []byte) ([]byte, error) {
+	dir, err := ioutil.TempDir("", "rum-fmt")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	orig, formatted := filepath.Join(dir, "orig"), filepath.Join(dir, "formatted")
+	if err := ioutil.WriteFile(orig, a, 0600); err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(formatted, b, 0600); err != nil {
+		return nil, err
+	}
+
+	cmd := exec.Command("diff", "-u", "--label", name+".orig", "--label", name, orig, formatted)
+	out, err := cmd.Output()
+	if len(out) > 0 {
+		// diff exits with 1 when the files differ.
+		return out, nil
+	}
+	return nil, err
+}
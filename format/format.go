@@ -0,0 +1,222 @@
+// Package format implements the canonical formatting of Rum source code.
+package format
+
+import (
+	"errors"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/rumlang/rum/parser"
+)
+
+// bodyForms are the forms whose arguments are indented by two spaces, like a
+// body, instead of being aligned with their first argument.
+var bodyForms = map[string]bool{
+	"begin":       true,
+	"case":        true,
+	"cond":        true,
+	"def":         true,
+	"defmethod":   true,
+	"defmulti":    true,
+	"defprotocol": true,
+	"defrecord":   true,
+	"defstruct":   true,
+	"do":          true,
+	"doseq":       true,
+	"extend-type": true,
+	"for":         true,
+	"for-each":    true,
+	"if":          true,
+	"import":      true,
+	"lambda":      true,
+	"lazy-seq":    true,
+	"let":         true,
+	"let*":        true,
+	"letrec":      true,
+	"loop":        true,
+	"match":       true,
+	"package":     true,
+	"unless":      true,
+	"when":        true,
+}
+
+// Source formats src in the canonical style, and returns the result. Within
+// the source, the line breaks and comments are kept, at most one blank line
+// separates two expressions, and each line is indented from the list it
+// belongs to:
+//
+//   - the arguments of the body forms (def, lambda, let, if, ...) and of the
+//     calls with no argument on the first line are indented by two spaces;
+//   - the arguments of other calls are aligned with the first one;
+//   - the elements of lists which do not start with an identifier are aligned
+//     with the first element.
+//
+// The closing parentheses are moved to the end of the last line of their
+// list, unless it ends with a comment. An error is returned if src is not
+// valid UTF-8, or if its parentheses or strings are not terminated.
+func Source(src []byte) ([]byte, error) {
+	if !utf8.Valid(src) {
+		return nil, errors.New("source is not valid UTF-8")
+	}
+	root, err := parser.ParseCST(parser.NewSource(string(src)))
+	if err != nil {
+		return nil, err
+	}
+	p := &printer{}
+	p.file(root)
+	return []byte(p.b.String()), nil
+}
+
+// element is a node which is not a space, with the number of line breaks
+// before it in the source.
+type element struct {
+	node     *parser.Node
+	newlines int
+	// line and col are where the element starts in the output.
+	line, col int
+}
+
+// elements returns the elements of the children of a node.
+func elements(children []*parser.Node) []*element {
+	var elts []*element
+	newlines := 0
+	for _, n := range children {
+		if n.Kind == parser.NodeSpace {
+			newlines += strings.Count(n.Text, "\n")
+			continue
+		}
+		elts = append(elts, &element{node: n, newlines: newlines})
+		newlines = 0
+	}
+	return elts
+}
+
+// printer writes formatted source, keeping track of the position of the next
+// rune.
+type printer struct {
+	b         strings.Builder
+	line, col int
+}
+
+func (p *printer) write(s string) {
+	p.b.WriteString(s)
+	if i := strings.LastIndexByte(s, '\n'); i >= 0 {
+		p.line += strings.Count(s, "\n")
+		p.col = utf8.RuneCountInString(s[i+1:])
+	} else {
+		p.col += utf8.RuneCountInString(s)
+	}
+}
+
+// newline starts a new line indented by indent spaces, after a blank line if
+// blank is true.
+func (p *printer) newline(blank bool, indent int) {
+	if blank {
+		p.write("\n")
+	}
+	p.write("\n" + strings.Repeat(" ", indent))
+}
+
+func (p *printer) file(root *parser.Node) {
+	elts := elements(root.Children)
+	for i, e := range elts {
+		if i > 0 {
+			p.separate(elts[i-1], e, 0)
+		}
+		p.element(e)
+	}
+	if len(elts) > 0 {
+		p.write("\n")
+	}
+}
+
+// separate writes what separates the elements prev and e: a line break
+// indented by indent if there is one in the source (always after a comment),
+// else a space.
+func (p *printer) separate(prev, e *element, indent int) {
+	if e.newlines > 0 || prev.node.Kind == parser.NodeComment {
+		p.newline(e.newlines > 1, indent)
+		return
+	}
+	p.write(" ")
+}
+
+func (p *printer) element(e *element) {
+	e.line, e.col = p.line, p.col
+	n := e.node
+	switch n.Kind {
+	case parser.NodeList:
+		p.list(n)
+	case parser.NodeDeref:
+		p.deref(n)
+	case parser.NodeComment:
+		p.write(strings.TrimRightFunc(n.Text, unicode.IsSpace))
+	default:
+		p.write(n.Text)
+	}
+}
+
+func (p *printer) list(n *parser.Node) {
+	open := p.col
+	p.write("(")
+	elts := elements(n.Children)
+	for i, e := range elts {
+		switch {
+		case i > 0:
+			p.separate(elts[i-1], e, indent(open, elts[:i]))
+		case e.node.Kind == parser.NodeComment && e.newlines > 0:
+			p.newline(false, open+1)
+		}
+		p.element(e)
+	}
+	if len(elts) > 0 && elts[len(elts)-1].node.Kind == parser.NodeComment {
+		// The parenthesis can not be on the line of the comment.
+		p.newline(false, open)
+	}
+	p.write(")")
+}
+
+func (p *printer) deref(n *parser.Node) {
+	at := p.col
+	p.write("@")
+	elts := elements(n.Children)
+	for i, e := range elts {
+		if i > 0 && elts[i-1].node.Kind == parser.NodeComment {
+			p.newline(false, at+1)
+		}
+		p.element(e)
+	}
+}
+
+// indent returns the indentation of the next element of the list opened at
+// column open, which starts with prev.
+func indent(open int, prev []*element) int {
+	var values []*element
+	for _, e := range prev {
+		if e.node.Kind != parser.NodeComment {
+			values = append(values, e)
+		}
+	}
+	if len(values) == 0 || !isIdentifier(values[0].node) {
+		return open + 1
+	}
+	head := values[0]
+	if bodyForms[head.node.Text] || len(values) == 1 || values[1].line != head.line {
+		return open + 2
+	}
+	return values[1].col
+}
+
+// isIdentifier reports whether n is an identifier, as opposed to a number, a
+// string or a list.
+func isIdentifier(n *parser.Node) bool {
+	if n.Kind != parser.NodeAtom {
+		return false
+	}
+	text := []rune(n.Text)
+	if text[0] == '"' || unicode.IsDigit(text[0]) {
+		return false
+	}
+	return len(text) == 1 || !strings.ContainsRune("+-.", text[0]) || !unicode.IsDigit(text[1])
+}
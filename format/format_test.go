@@ -0,0 +1,123 @@
+package format
+
+import (
+	"io/ioutil"
+	"math/rand"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/rumlang/rum/parser"
+)
+
+func TestSource(t *testing.T) {
+	tests := map[string]string{
+		"":                       "",
+		"  foo  ":                "foo\n",
+		"( a   b\t(c) )":         "(a b (c))\n",
+		"(a)\n\n\n\n(b) (c)\n\n": "(a)\n\n(b) (c)\n",
+		"(def f (x)\n      (+ x\n 1)\n)": "(def f (x)\n" +
+			"  (+ x\n" +
+			"     1))\n",
+		"(foo\n a\n b)":             "(foo\n  a\n  b)\n",
+		"(foo a\nb\n  c)":           "(foo a\n     b\n     c)\n",
+		"((lambda (x) x)\n1)":       "((lambda (x) x)\n 1)\n",
+		"(1 2\n3)":                  "(1 2\n 3)\n",
+		"(if (a)\n(b)\n(c))":        "(if (a)\n  (b)\n  (c))\n",
+		"(a ; comment  \n b)":       "(a ; comment\n  b)\n",
+		"(a\n; comment\nb\n)":       "(a\n  ; comment\n  b)\n",
+		"(a b ; comment\n)":         "(a b ; comment\n)\n",
+		"(\n; first\na)":            "(\n ; first\n a)\n",
+		"(a @ b @(c\nd))":           "(a @b @(c\n         d))\n",
+		"(f \"a\n  b\" c\n d)":      "(f \"a\n  b\" c\n   d)\n",
+		"(a\r\n  b)\r\n":            "(a\n  b)\n",
+		"; only a comment":          "; only a comment\n",
+		"(é (ü)\n (x))":             "(é (ü)\n   (x))\n",
+		"(package \"main\"\n(a)\n)": "(package \"main\"\n  (a))\n",
+	}
+	for input, expected := range tests {
+		out, err := Source([]byte(input))
+		if err != nil {
+			t.Errorf("Input %q - unexpected error: %v", input, err)
+			continue
+		}
+		if string(out) != expected {
+			t.Errorf("Input %q - expected:\n%s\ngot:\n%s", input, expected, out)
+		}
+	}
+
+	invalid := []string{"(a", "(a))", "(a \"b)", "\xc3\x28"}
+	for _, input := range invalid {
+		if _, err := Source([]byte(input)); err == nil {
+			t.Errorf("Input %q - expected an error", input)
+		}
+	}
+}
+
+// checkFormat checks that formatting src does not change its values, and that
+// formatting the result again does not change it.
+func checkFormat(t *testing.T, src string) {
+	out, err := Source([]byte(src))
+	if err != nil {
+		t.Errorf("Input %q - unexpected error: %v", src, err)
+		return
+	}
+	again, err := Source(out)
+	if err != nil || string(again) != string(out) {
+		t.Errorf("Input %q - formatting is not idempotent:\n%s\nthen:\n%s", src, out, again)
+	}
+
+	// The sources are wrapped, as a file can contain several expressions.
+	parse := func(s string) string {
+		v, err := parser.Parse(parser.NewSource("(" + s + "\n)"))
+		if err != nil {
+			t.Fatalf("Unable to parse %q: %v", s, err)
+		}
+		return parser.Format(v)
+	}
+	if before, after := parse(src), parse(string(out)); before != after {
+		t.Errorf("Input %q - formatting changed the values from %s to %s", src, before, after)
+	}
+}
+
+func TestSourceExamples(t *testing.T) {
+	files, err := filepath.Glob("../examples/*.rum")
+	if err != nil || len(files) == 0 {
+		t.Fatalf("No example found: %v", err)
+	}
+	for _, file := range files {
+		src, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkFormat(t, string(src))
+	}
+}
+
+// TestSourceLayouts formats expressions whose spaces are replaced by random
+// spaces, line breaks and comments.
+func TestSourceLayouts(t *testing.T) {
+	inputs := []string{
+		`(def fact (n) (if (< n 2) 1 (* n (fact (- n 1)))))`,
+		`(let* ((a 1) (b "x y ; z")) (println a @b (list 1.5 -2)))`,
+		`((lambda (x) x) (f a b c) (1 2 3) (g (h) @(i j)))`,
+	}
+	separators := []string{" ", "  ", "\n", "\n\n\n", " ; comment\n", "\n;; comment\n\n", "\t"}
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 200; i++ {
+		input := inputs[i%len(inputs)]
+		var b strings.Builder
+		inString := false
+		for _, c := range input {
+			switch {
+			case c == '"':
+				inString = !inString
+			case c == ' ' && !inString:
+				b.WriteString(separators[r.Intn(len(separators))])
+				continue
+			}
+			b.WriteRune(c)
+		}
+		checkFormat(t, b.String())
+	}
+}
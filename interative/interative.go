@@ -72,6 +72,7 @@ func REPL() (err error) {
 
 	// Prepare runtime environment
 	ctx := rumRuntime.NewContext(nil)
+	ctx.AllowRedefinition(true)
 	ctx.Set("exit", parser.NewAny(func() {
 		os.Exit(0)
 	}, nil))
@@ -120,8 +121,25 @@ func REPL() (err error) {
 			continue
 		}
 
-		v := out.Value()
-		fmt.Println(v)
+		if err = printValue(os.Stdout, out); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+		}
 	}
 	return
 }
+
+// printValue prints v, as Rum source, to w. Printing realizes the lazy
+// sequences, which can fail after the evaluation.
+func printValue(w io.Writer, v parser.Value) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			if e, ok := r.(error); ok {
+				err = e
+				return
+			}
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+	_, err = fmt.Fprintln(w, rumRuntime.PrString(v))
+	return err
+}
@@ -1,8 +1,12 @@
 package interative
 
 import (
+	"bytes"
 	"os/user"
 	"testing"
+
+	"github.com/rumlang/rum/parser"
+	rumRuntime "github.com/rumlang/rum/runtime"
 )
 
 func TestExpandFilename(t *testing.T) {
@@ -23,3 +27,27 @@ func TestExpandFilename(t *testing.T) {
 		}
 	}
 }
+
+func TestPrintValue(t *testing.T) {
+	ctx := rumRuntime.NewContext(nil)
+	data := map[string]string{
+		"(list 1 \"a\")": "(1 \"a\")\n",
+		"(map (lambda (x) (panic x)) (seq (list 1)))": "",
+	}
+
+	for input, expected := range data {
+		root, err := parser.Parse(parser.NewSource(input))
+		if err != nil {
+			t.Fatalf("Unable to parse %q: %v", input, err)
+		}
+		v, err := ctx.TryEval(root)
+		if err != nil {
+			t.Fatalf("Input %q - unexpected error: %v", input, err)
+		}
+		var out bytes.Buffer
+		err = printValue(&out, v)
+		if out.String() != expected || (err == nil) != (expected != "") {
+			t.Errorf("Input %q - expected %q, got %q, %v", input, expected, out.String(), err)
+		}
+	}
+}
@@ -12,7 +12,13 @@ import (
 )
 
 func main() {
+	// Subcommands
+	if len(os.Args) > 1 && os.Args[1] == "fmt" {
+		os.Exit(formatMain(os.Args[2:]))
+	}
+
 	// Check arguments
+	debug := flag.Bool("debug", false, "print the interpreter stack on internal errors")
 	flag.Parse()
 
 	if len(flag.Args()) > 1 {
@@ -33,7 +39,7 @@ func main() {
 	var input = ""
 	if len(flag.Args()) > 0 {
 		// Get code from a file if specified
-		filepath := os.Args[1]
+		filepath := flag.Arg(0)
 		file, err := os.Open(filepath)
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "not found file %q: %v\n", filepath, err)
@@ -59,7 +65,8 @@ func main() {
 	}
 
 	ctx := runtime.NewContext(nil)
-	if _, err = ctx.TryEval(root); err != nil {
+	ctx.SetDebug(*debug)
+	if _, err = runtime.Compile(ctx, root).Run(); err != nil {
 		fmt.Fprintf(os.Stderr, "execution failed: %v", err)
 		os.Exit(1)
 	}
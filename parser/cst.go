@@ -0,0 +1,175 @@
+package parser
+
+import (
+	"strings"
+)
+
+// NodeKind is the kind of a node of a concrete syntax tree.
+type NodeKind int
+
+const (
+	// NodeFile is the root of a tree: the sequence of its children.
+	NodeFile NodeKind = iota
+	// NodeList is a list: its children between parentheses.
+	NodeList
+	// NodeDeref is the @ prefix, followed by its children: trivia and the
+	// expression.
+	NodeDeref
+	// NodeAtom is an identifier, a number or a string.
+	NodeAtom
+	// NodeComment is a comment, up to the end of the line (excluded).
+	NodeComment
+	// NodeSpace is a sequence of spaces, including newlines.
+	NodeSpace
+)
+
+// Node is a node of a concrete syntax tree, which keeps all the source,
+// including the spaces and comments the parser discards. It is meant for the
+// tools which rewrite source code, like formatters.
+type Node struct {
+	Kind NodeKind
+	// Text is the source of the atoms, comments and spaces.
+	Text string
+	// Children are the nodes of files, lists and derefs.
+	Children []*Node
+	// Ref is where the node begins in the source.
+	Ref *SourceRef
+}
+
+// String returns the source of the node, identical to the parsed input once
+// its invalid byte sequences are removed.
+func (n *Node) String() string {
+	var b strings.Builder
+	n.write(&b)
+	return b.String()
+}
+
+func (n *Node) write(b *strings.Builder) {
+	switch n.Kind {
+	case NodeList:
+		b.WriteByte('(')
+	case NodeDeref:
+		b.WriteByte('@')
+	}
+	b.WriteString(n.Text)
+	for _, child := range n.Children {
+		child.write(b)
+	}
+	if n.Kind == NodeList {
+		b.WriteByte(')')
+	}
+}
+
+// IsTrivia reports whether the node has no value: spaces and comments.
+func (n *Node) IsTrivia() bool {
+	return n.Kind == NodeSpace || n.Kind == NodeComment
+}
+
+// ParseCST parses src into a concrete syntax tree. Unlike Parse, the source
+// can contain any number of expressions, which are not converted to values.
+// The errors are only about the structure of the source: unbalanced
+// parentheses, unterminated strings and missing expressions after @.
+func ParseCST(src *Source) (*Node, error) {
+	l := newLexer(src)
+	l.trivia = true
+	b := &cstBuilder{lex: l}
+	root := &Node{Kind: NodeFile, Ref: &SourceRef{Source: src}}
+
+	for {
+		t := b.next()
+		if t.id == tokEOF {
+			break
+		}
+		if t.id == tokClose {
+			b.error(t, "unexpected ')'")
+			continue
+		}
+		root.Children = append(root.Children, b.node(t))
+	}
+
+	if len(b.errors) > 0 {
+		return nil, MultiError{Errors: b.errors}
+	}
+	return root, nil
+}
+
+// cstBuilder builds a concrete syntax tree from the tokens of a lexer which
+// keeps the trivia.
+type cstBuilder struct {
+	lex    *lexer
+	errors []error
+}
+
+func (b *cstBuilder) next() tokenInfo {
+	return b.lex.Next().(tokenInfo)
+}
+
+func (b *cstBuilder) error(t tokenInfo, msg string) {
+	b.errors = append(b.errors, Error{Msg: msg, Code: ErrInvalidNudToken, Ref: t.ref})
+}
+
+// node returns the node beginning with t.
+func (b *cstBuilder) node(t tokenInfo) *Node {
+	n := &Node{Ref: t.ref}
+	switch t.id {
+	case tokOpen:
+		n.Kind = NodeList
+		for {
+			child := b.next()
+			if child.id == tokClose {
+				break
+			}
+			if child.id == tokEOF {
+				b.errors = append(b.errors, Error{
+					Msg:  "invalid token - expected ')', got EOF",
+					Code: ErrMissingClosingParenthesis,
+					Ref:  child.ref,
+				})
+				break
+			}
+			n.Children = append(n.Children, b.node(child))
+		}
+	case tokDeref:
+		n.Kind = NodeDeref
+		for {
+			child := b.next()
+			if child.id == tokEOF || child.id == tokClose {
+				b.error(child, "expected an expression after @")
+				break
+			}
+			n.Children = append(n.Children, b.node(child))
+			if !n.Children[len(n.Children)-1].IsTrivia() {
+				break
+			}
+		}
+	case tokSpace:
+		n.Kind = NodeSpace
+	case tokComment:
+		n.Kind = NodeComment
+	case tokString:
+		n.Kind = NodeAtom
+		if !terminated(t.text) {
+			b.error(t, "unterminated string")
+		}
+	default:
+		n.Kind = NodeAtom
+	}
+	if n.Kind != NodeList && n.Kind != NodeDeref {
+		n.Text = string(t.text)
+	}
+	return n
+}
+
+// terminated reports whether the string literal text ends with a closing
+// quote.
+func terminated(text []rune) bool {
+	for i := 1; i < len(text); i++ {
+		switch text[i] {
+		case '\\':
+			i++
+		case '"':
+			return i == len(text)-1
+		}
+	}
+	return false
+}
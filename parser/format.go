@@ -0,0 +1,130 @@
+package parser
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Print writes v to w as canonical Rum source: lists are written on a single
+// line, with their elements separated by one space. Parse reads it back as an
+// equal value, except nil and the booleans, which have no literal: they are
+// written as the identifiers evaluating to them, and read back as those
+// identifiers.
+//
+// Comments are not part of the values, so they are not written. An error is
+// returned if v contains a value which has no literal: NaN and infinite
+// floats, identifiers which would not be read as such, or any other Go type.
+func Print(w io.Writer, v Value) error {
+	bw := bufio.NewWriter(w)
+	if err := printValue(bw, v); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// Format returns v as canonical Rum source. It is similar to Print, but it
+// panics if v can not be written.
+func Format(v Value) string {
+	var b strings.Builder
+	if err := Print(&b, v); err != nil {
+		panic(err)
+	}
+	return b.String()
+}
+
+func printValue(w *bufio.Writer, v Value) error {
+	switch data := v.Value().(type) {
+	case nil:
+		w.WriteString("nil")
+	case bool:
+		w.WriteString(strconv.FormatBool(data))
+	case int64:
+		w.WriteString(strconv.FormatInt(data, 10))
+	case int:
+		w.WriteString(strconv.Itoa(data))
+	case float64:
+		if math.IsInf(data, 0) || math.IsNaN(data) {
+			return fmt.Errorf("%v has no literal", data)
+		}
+		s := strconv.FormatFloat(data, 'g', -1, 64)
+		if !strings.ContainsAny(s, ".e") {
+			// Without a dot, it would be read back as an integer.
+			s += ".0"
+		}
+		w.WriteString(s)
+	case string:
+		w.WriteString(Quote(data))
+	case Identifier:
+		if !isIdentifier(string(data)) {
+			return fmt.Errorf("%q is not a valid identifier", string(data))
+		}
+		w.WriteString(string(data))
+	case []Value:
+		w.WriteByte('(')
+		for i, elt := range data {
+			if i != 0 {
+				w.WriteByte(' ')
+			}
+			if err := printValue(w, elt); err != nil {
+				return err
+			}
+		}
+		w.WriteByte(')')
+	default:
+		return fmt.Errorf("%T has no literal", data)
+	}
+	return nil
+}
+
+// Quote returns s as a string literal. The quotes, backslashes, newlines,
+// tabs, carriage returns and null characters are escaped.
+func Quote(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for _, r := range s {
+		switch r {
+		case '"', '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case '\n':
+			b.WriteString(`\n`)
+		case '\t':
+			b.WriteString(`\t`)
+		case '\r':
+			b.WriteString(`\r`)
+		case 0:
+			b.WriteString(`\0`)
+		default:
+			b.WriteRune(r)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+// isIdentifier reports whether the lexer reads s as a single identifier.
+func isIdentifier(s string) bool {
+	if s == "" || s[0] == '@' || looksLikeNumber([]rune(s)) {
+		return false
+	}
+	for _, r := range s {
+		if r == '(' || r == ')' || r == ';' || r == '"' || r == 0 || r == unicode.ReplacementChar || unicode.IsSpace(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// looksLikeNumber reports whether the lexer parses text as a number:
+// anything starting with [+-.]?[0-9].
+func looksLikeNumber(text []rune) bool {
+	return (len(text) > 1 &&
+		(text[0] == '+' || text[0] == '-' || text[0] == '.') &&
+		unicode.IsDigit(text[1])) ||
+		unicode.IsDigit(text[0])
+}
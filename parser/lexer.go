@@ -3,6 +3,7 @@ package parser
 import (
 	"fmt"
 	"strconv"
+	"strings"
 	"unicode"
 )
 
@@ -43,63 +44,107 @@ func (e Error) Error() string {
 	return fmt.Sprintf("%s at line %d, col %d: %s", e.Code, e.Ref.Line+1, e.Ref.Column+1, e.Msg)
 }
 
-// stateFn is the prototype for function of the lexer state machine. They don't
-// take any parameter - data is shared through the object.
-type stateFn func() (stateFn, error)
+// stateFn is the prototype for function of the lexer state machine. They are
+// method expressions of the lexer, so that changing state does not allocate.
+type stateFn func(*lexer) (stateFn, error)
 
-// lexer extract the tokens seen in the input.
+// lexer extract the tokens seen in the input. It is pull-based: the state
+// machine runs when the parser asks for the next token, over the runes the
+// source already holds.
 type lexer struct {
 	// source is the data that the lexer is working on.
 	source *Source
-	// scan is obtained from the source object and provides all the valid rune in
-	// the input.
-	scan <-chan rune
-	// next contains the next rune that would be added to current token with
-	// avance().
-	next rune
+	// data contains all the valid runes of the source.
+	data []rune
+	// pos is the index in data of the next rune, which would be added to
+	// current token with advance().
+	pos int
 	// nextCol is the rune index on the current line. Ignores invalid byte
 	// sequences; 0-indexed.
 	nextCol int
-	// current line number of the rune in 'next'. 0 indexed.
+	// current line number of the rune at pos. 0 indexed.
 	line int
-	// token is the token being built - it will be sent to the channel once
-	// accept() is called.
-	token   *tokenInfo
-	tokens  chan tokenInfo
-	errors  []string
-	program Value
+	// start, startLine and startCol locate the beginning of the token being
+	// built, returned once accept() is called.
+	start     int
+	startLine int
+	startCol  int
+	// state is the next state of the machine; nil once the input is
+	// exhausted.
+	state stateFn
+	// token is the last token emitted by a state, returned by Next, if
+	// pending is true.
+	token   tokenInfo
+	pending bool
+	// refs is a block of preallocated source references.
+	refs []SourceRef
+	// trivia makes the lexer emit the spaces and comments as tokens, instead
+	// of discarding them.
+	trivia bool
 }
 
 // peek looks one rune ahead in the input but does not advance the current
 // pointer. It should never return RuneError.
 func (l *lexer) peek() rune {
-	return l.next
+	if l.pos >= len(l.data) {
+		return 0
+	}
+	return l.data[l.pos]
 }
 
 // advance moves the current position by one rune. Returns the rune encountered
 // or 0 if there is nothing remaining.
 func (l *lexer) advance() rune {
-	r := l.next
-	l.token.text = append(l.token.text, r)
+	if l.pos >= len(l.data) {
+		return 0
+	}
+	r := l.data[l.pos]
+	l.pos++
 	l.nextCol++
 	if r == '\n' {
 		l.line++
 		l.nextCol = 0
 	}
-	l.next = <-l.scan
 	return r
 }
 
+// accept returns the token made of the runes since the last call to accept
+// or ignore.
 func (l *lexer) accept() tokenInfo {
-	t := l.token
-	l.token = &tokenInfo{
-		ref: &SourceRef{
-			Source: l.source,
-			Line:   l.line,
-			Column: l.nextCol,
-		},
+	t := tokenInfo{
+		text: l.data[l.start:l.pos],
+		ref:  l.newRef(l.startLine, l.startCol),
+	}
+	l.ignore()
+	return t
+}
+
+// newRef returns a reference to the source, allocated by blocks as there is
+// one for each token.
+func (l *lexer) newRef(line, col int) *SourceRef {
+	const block = 256
+	if len(l.refs) == 0 {
+		l.refs = make([]SourceRef, block)
 	}
-	return *t
+	ref := &l.refs[0]
+	l.refs = l.refs[1:]
+	*ref = SourceRef{
+		Source: l.source,
+		Line:   line,
+		Column: col,
+	}
+	return ref
+}
+
+// ignore drops the runes since the last call to accept or ignore.
+func (l *lexer) ignore() {
+	l.start, l.startLine, l.startCol = l.pos, l.line, l.nextCol
+}
+
+// emit makes t the token returned by Next.
+func (l *lexer) emit(t tokenInfo) {
+	l.token = t
+	l.pending = true
 }
 
 // stateIdentifier parses arbitrary strings & numbers.
@@ -108,59 +153,62 @@ func (l *lexer) stateIdentifier() (next stateFn, err error) {
 		r := l.peek()
 		switch {
 		case r == '(':
-			next = l.stateOpen
+			next = (*lexer).stateOpen
 		case r == ')':
-			next = l.stateClose
+			next = (*lexer).stateClose
 		case r == ';':
-			next = l.stateComment
+			next = (*lexer).stateComment
 		case r == '"':
-			next = l.stateString
+			next = (*lexer).stateString
+		case r == '@' && l.pos == l.start:
+			next = (*lexer).stateDeref
 		case unicode.IsSpace(r):
-			next = l.stateSpace
+			next = (*lexer).stateSpace
 		case r == 0: // rune is 0 when scan is finished.
-			next = l.stateEnd
+			next = (*lexer).stateEnd
 		default:
 			l.advance()
 		}
 	}
 
-	token := l.accept()
-
 	// Ignore empty transition - they're just a parsing artifact.
-	if len(token.text) == 0 {
+	if l.pos == l.start {
 		return
 	}
+	token := l.accept()
 
 	token.id = tokIdentifier
-	// Use []rune for identifiers?
-	token.value = string(token.text)
+	text := string(token.text)
 
 	// Check the first rune to determine whether it is just an arbitrary
 	// identifier or a number. Anything starting with [+-.]?[0-9] is considered a
 	// number.
-	if (len(token.text) > 1 &&
-		(token.text[0] == '+' || token.text[0] == '-' || token.text[0] == '.') &&
-		unicode.IsDigit(token.text[1])) ||
-		unicode.IsDigit(token.text[0]) {
+	if looksLikeNumber(token.text) {
 		// Try first to parse it as an integer and if it does not work, try as a
 		// float. This is ugly and number management should probably be rewritten.
 		token.id = tokInteger
 		var i int64
-		i, err = strconv.ParseInt(string(token.text), 10, 64)
+		i, err = strconv.ParseInt(text, 10, 64)
 		if err != nil {
 			var f float64
-			f, err = strconv.ParseFloat(string(token.text), 64)
+			f, err = strconv.ParseFloat(text, 64)
 			if err != nil {
-				return
+				// The parser reports the invalid token.
+				token.id = tokInvalidNumber
+				l.emit(token)
+				return next, nil
 			}
 			token.id = tokFloat
 			token.value = f
-			l.tokens <- token
+			l.emit(token)
 			return
 		}
 		token.value = i
+		l.emit(token)
+		return
 	}
-	l.tokens <- token
+	token.value = Intern(text)
+	l.emit(token)
 	return
 }
 
@@ -169,8 +217,8 @@ func (l *lexer) stateOpen() (stateFn, error) {
 	token := l.accept()
 	// TODO: check that it is the right character and fail otherwise.
 	token.id = tokOpen
-	l.tokens <- token
-	return l.stateIdentifier, nil
+	l.emit(token)
+	return (*lexer).stateIdentifier, nil
 }
 
 func (l *lexer) stateClose() (stateFn, error) {
@@ -178,8 +226,8 @@ func (l *lexer) stateClose() (stateFn, error) {
 	token := l.accept()
 	// TODO: check that it is the right character and fail otherwise.
 	token.id = tokClose
-	l.tokens <- token
-	return l.stateIdentifier, nil
+	l.emit(token)
+	return (*lexer).stateIdentifier, nil
 }
 
 func (l *lexer) stateArray() (stateFn, error) {
@@ -187,114 +235,115 @@ func (l *lexer) stateArray() (stateFn, error) {
 	token := l.accept()
 	// TODO: check that it is the right character and fail otherwise.
 	token.id = tokArray
-	l.tokens <- token
-	return l.stateIdentifier, nil
+	l.emit(token)
+	return (*lexer).stateIdentifier, nil
+}
+
+// stateDeref parses the @ prefix, a shortcut for (deref ...).
+func (l *lexer) stateDeref() (stateFn, error) {
+	l.advance()
+	token := l.accept()
+	token.id = tokDeref
+	l.emit(token)
+	return (*lexer).stateIdentifier, nil
 }
 
 func (l *lexer) stateSpace() (stateFn, error) {
 	for unicode.IsSpace(l.peek()) {
 		l.advance()
 	}
-	// We don't emit anything for spaces.
-	l.accept()
-	return l.stateIdentifier, nil
+	l.emitTrivia(tokSpace)
+	return (*lexer).stateIdentifier, nil
 }
 
 func (l *lexer) stateComment() (stateFn, error) {
 	for l.peek() != '\n' && l.peek() != 0 {
 		l.advance()
 	}
-	// We don't emit anything for comments.
-	l.accept()
-	return l.stateIdentifier, nil
+	l.emitTrivia(tokComment)
+	return (*lexer).stateIdentifier, nil
+}
+
+// emitTrivia emits the spaces or comment just read as a token of type id, or
+// discards them unless the lexer keeps the trivia.
+func (l *lexer) emitTrivia(id tokenID) {
+	if !l.trivia {
+		l.ignore()
+		return
+	}
+	token := l.accept()
+	token.id = id
+	l.emit(token)
 }
 
+// escapes are the characters written with a backslash in strings.
+var escapes = map[rune]rune{'n': '\n', 't': '\t', 'r': '\r', '0': 0}
+
 func (l *lexer) stateString() (stateFn, error) {
 	// Get the opening array.
 	l.advance()
-	s := ""
+	var s strings.Builder
 	for l.peek() != '"' {
 		r := l.advance()
 
 		if r == '\\' {
-			// Just get the character after the backslash - good enough to catch
-			// escape arrays.
+			// Get the character after the backslash, which is either an escape
+			// sequence or the character itself (e.g., a quote).
 			r = l.advance()
+			if r == 0 {
+				break
+			}
+			if escaped, ok := escapes[r]; ok {
+				s.WriteRune(escaped)
+				continue
+			}
 		}
 
 		if r == 0 {
 			// TODO - generate an error
 			break
 		}
-		s += string(r)
+		s.WriteRune(r)
 	}
 
 	// Get the last array
 	l.advance()
 	token := l.accept()
 	token.id = tokString
-	token.value = s
-	l.tokens <- token
-	return l.stateIdentifier, nil
+	token.value = s.String()
+	l.emit(token)
+	return (*lexer).stateIdentifier, nil
 }
 
 func (l *lexer) stateEnd() (stateFn, error) {
 	return nil, nil
 }
 
-func (l *lexer) run() error {
-	s, err := l.stateIdentifier()
-	if err != nil {
-		return err
-	}
-	for {
-		s, err = s()
+// Next runs the state machine until it emits a token, and returns it. Once
+// the input is exhausted, it returns EOF tokens.
+func (l *lexer) Next() Token {
+	for !l.pending && l.state != nil {
+		var err error
+		l.state, err = l.state(l)
 		if err != nil {
 			fmt.Println(err)
 		}
-
-		if s == nil {
-			break
-		}
 	}
-	close(l.tokens)
-	return nil
-}
-
-func (l *lexer) Next() Token {
-	token, ok := <-l.tokens
-	if !ok {
-		token = tokenInfo{
-			id: tokEOF,
-			ref: &SourceRef{
-				Source: l.source,
-				Line:   l.line,
-				Column: l.nextCol,
-			},
+	if !l.pending {
+		return tokenInfo{
+			id:  tokEOF,
+			ref: l.newRef(l.line, l.nextCol),
 		}
 	}
-	return token
+	l.pending = false
+	return l.token
 }
 
 func newLexer(src *Source) *lexer {
 	l := &lexer{
 		source: src,
-		scan:   src.Scan(),
-		token:  &tokenInfo{},
-		// As we are starting with a fake advance, we must make sure that indexing
-		// stays correct.
-		nextCol: -1,
-		tokens:  make(chan tokenInfo),
+		data:   src.data,
 	}
-	// Do an initial advance/accept to get the first character into 'next' and
-	// make sure than the current token is properly initialized.
-	l.advance()
-	l.accept()
-	go func() {
-		err := l.run()
-		if err != nil {
-			fmt.Println(err)
-		}
-	}()
+	l.state = (*lexer).stateIdentifier
 	return l
 }
@@ -1,40 +1,55 @@
 package parser
 
 import (
+	"fmt"
+	"math"
+	"math/rand"
 	"reflect"
+	"strings"
 	"testing"
+	"testing/quick"
 )
 
+// lexAll returns all the tokens of input, up to EOF.
+func lexAll(input string) []tokenInfo {
+	l := newLexer(NewSource(input))
+	tokens := []tokenInfo{}
+	for t := l.Next().(tokenInfo); t.id != tokEOF; t = l.Next().(tokenInfo) {
+		tokens = append(tokens, t)
+	}
+	return tokens
+}
+
 func TestLexer(t *testing.T) {
 	tests := map[string][]tokenInfo{
 		"foo": {
-			{text: []rune{'f', 'o', 'o'}, id: tokIdentifier, value: "foo", ref: &SourceRef{Line: 0, Column: 0}},
+			{text: []rune{'f', 'o', 'o'}, id: tokIdentifier, value: Intern("foo"), ref: &SourceRef{Line: 0, Column: 0}},
 		},
 		"(foo)": {
 			{text: []rune{'('}, id: tokOpen, ref: &SourceRef{Line: 0, Column: 0}},
-			{text: []rune{'f', 'o', 'o'}, id: tokIdentifier, value: "foo", ref: &SourceRef{Line: 0, Column: 1}},
+			{text: []rune{'f', 'o', 'o'}, id: tokIdentifier, value: Intern("foo"), ref: &SourceRef{Line: 0, Column: 1}},
 			{text: []rune{')'}, id: tokClose, ref: &SourceRef{Line: 0, Column: 4}},
 		},
 		" (  foo ) ": {
 			{text: []rune{'('}, id: tokOpen, ref: &SourceRef{Line: 0, Column: 1}},
-			{text: []rune{'f', 'o', 'o'}, id: tokIdentifier, value: "foo", ref: &SourceRef{Line: 0, Column: 4}},
+			{text: []rune{'f', 'o', 'o'}, id: tokIdentifier, value: Intern("foo"), ref: &SourceRef{Line: 0, Column: 4}},
 			{text: []rune{')'}, id: tokClose, ref: &SourceRef{Line: 0, Column: 8}},
 		},
 		" \nfoo": {
-			{text: []rune{'f', 'o', 'o'}, id: tokIdentifier, value: "foo", ref: &SourceRef{Line: 1, Column: 0}},
+			{text: []rune{'f', 'o', 'o'}, id: tokIdentifier, value: Intern("foo"), ref: &SourceRef{Line: 1, Column: 0}},
 		},
 		"1.2": {
 			{text: []rune{'1', '.', '2'}, id: tokFloat, value: 1.2, ref: &SourceRef{Line: 0, Column: 0}},
 		},
+		"@a b@c": {
+			{text: []rune{'@'}, id: tokDeref, ref: &SourceRef{Line: 0, Column: 0}},
+			{text: []rune{'a'}, id: tokIdentifier, value: Intern("a"), ref: &SourceRef{Line: 0, Column: 1}},
+			{text: []rune{'b', '@', 'c'}, id: tokIdentifier, value: Intern("b@c"), ref: &SourceRef{Line: 0, Column: 3}},
+		},
 	}
 
 	for input, expected := range tests {
-		l := newLexer(NewSource(input))
-
-		tokens := []tokenInfo{}
-		for t := range l.tokens {
-			tokens = append(tokens, t)
-		}
+		tokens := lexAll(input)
 		if len(tokens) != len(expected) {
 			t.Fatalf("Expression %q - invalid number of tokens found; expected %#+v, found %#+v", input, expected, tokens)
 		}
@@ -57,10 +72,7 @@ func TestLexerErrors(t *testing.T) {
 	}
 
 	for input, count := range tests {
-		l := newLexer(NewSource(input))
-		for range l.tokens {
-			count--
-		}
+		count -= len(lexAll(input))
 		if count > 0 {
 			t.Errorf("Input %# x ; Not enough token found - %d more expected", input, count)
 		}
@@ -85,6 +97,8 @@ func TestParsingExpression(t *testing.T) {
 		"(a (b c) d (e f))": 4,
 		"(a\nb)":            2,
 		"(1.2 .3)":          2,
+		"(1 2x)":            -1,
+		"2x":                -1,
 
 		// Test strings
 		`(" `:        -1,
@@ -100,6 +114,11 @@ func TestParsingExpression(t *testing.T) {
 		"(array (a array(b c)))": 2,
 		"(array(a b) c)":         3,
 		"(a (array (b c)))":      2,
+
+		// Test deref
+		"(a @b)":       2,
+		"(a @(b c) d)": 3,
+		"(a @)":        -1,
 	}
 
 	for input, count := range tests {
@@ -113,7 +132,7 @@ func TestParsingExpression(t *testing.T) {
 			// Check that the error does not have issue generating context and is of
 			// the right type.
 			m := err.(MultiError)
-			m.Error()
+			_ = m.Error()
 			continue
 		}
 
@@ -139,6 +158,229 @@ func TestParsingAtoms(t *testing.T) {
 	}
 }
 
+func TestSymbols(t *testing.T) {
+	r, err := Parse(NewSource("(foo bar foo)"))
+	if err != nil {
+		t.Fatalf("Expected parsable code, got: %v", err)
+	}
+	list := r.Value().([]Value)
+	first, ok := SymbolOf(list[0])
+	if !ok || first != Intern("foo") || first.Name() != "foo" {
+		t.Errorf("Expected the symbol of 'foo', got: %v", first)
+	}
+	if last, _ := SymbolOf(list[2]); last != first {
+		t.Errorf("Expected the same symbol for both 'foo', got %d and %d", first, last)
+	}
+	if bar, _ := SymbolOf(list[1]); bar == first {
+		t.Errorf("Expected different symbols for 'foo' and 'bar'")
+	}
+	if _, ok := SymbolOf(NewAny("foo", nil)); ok {
+		t.Errorf("Expected strings not to have a symbol")
+	}
+	if sym, _ := SymbolOf(NewAny(Identifier("foo"), nil)); sym != first {
+		t.Errorf("Expected identifiers to be interned, got %d", sym)
+	}
+
+	// Symbols are shared by concurrent goroutines.
+	const n = 8
+	results := make(chan []Symbol, n)
+	for i := 0; i < n; i++ {
+		go func() {
+			var syms []Symbol
+			for j := 0; j < 100; j++ {
+				syms = append(syms, Intern(fmt.Sprintf("concurrent-%d", j)))
+			}
+			results <- syms
+		}()
+	}
+	expected := <-results
+	for i := 1; i < n; i++ {
+		if syms := <-results; !reflect.DeepEqual(syms, expected) {
+			t.Errorf("Expected the same symbols in all goroutines")
+		}
+	}
+	for j, sym := range expected {
+		if name := fmt.Sprintf("concurrent-%d", j); sym.Name() != name {
+			t.Errorf("Expected %q, got: %q", name, sym.Name())
+		}
+	}
+}
+
+func TestFormat(t *testing.T) {
+	tests := map[string]Value{
+		"foo":                NewAny(Identifier("foo"), nil),
+		"(a (1 -2) () b@c)":  mustParse("(a (1 -2) () b@c)"),
+		"(deref a)":          mustParse("@a"),
+		"1.0":                NewAny(1.0, nil),
+		"-0.0":               NewAny(math.Copysign(0, -1), nil),
+		"1e+21":              NewAny(1e21, nil),
+		"1.5e-07":            NewAny(1.5e-7, nil),
+		`"a\"b\\c"`:          NewAny(`a"b\c`, nil),
+		`"\n\t\r\0é"`:        NewAny("\n\t\r\x00é", nil),
+		"(nil true false 3)": NewAny([]Value{NewAny(nil, nil), NewAny(true, nil), NewAny(false, nil), NewAny(3, nil)}, nil),
+	}
+	for expected, v := range tests {
+		if s := Format(v); s != expected {
+			t.Errorf("Expected %q, got %q", expected, s)
+		}
+	}
+
+	invalid := []interface{}{
+		math.NaN(),
+		math.Inf(1),
+		Identifier(""),
+		Identifier("1a"),
+		Identifier("-1"),
+		Identifier("@a"),
+		Identifier("a b"),
+		Identifier("a(b"),
+		[]Value{NewAny(1.0, nil), NewAny(struct{}{}, nil)},
+	}
+	for _, v := range invalid {
+		if err := Print(&strings.Builder{}, NewAny(v, nil)); err == nil {
+			t.Errorf("Expected an error for %#v", v)
+		}
+	}
+}
+
+func mustParse(s string) Value {
+	v, err := Parse(NewSource(s))
+	if err != nil {
+		panic(fmt.Sprintf("Unable to parse %q: %v", s, err))
+	}
+	return v
+}
+
+// randomValue generates a value which can be formatted, with lists nested up
+// to depth.
+func randomValue(r *rand.Rand, depth int) Value {
+	const (
+		initials = "abcxyzABC*<>=!?:&_/éλ"
+		runes    = initials + "0123456789+-.@'#"
+	)
+	random := func(chars string, n int) string {
+		set := []rune(chars)
+		var b strings.Builder
+		for i := 0; i < n; i++ {
+			b.WriteRune(set[r.Intn(len(set))])
+		}
+		return b.String()
+	}
+
+	switch n := r.Intn(7); {
+	case n == 0:
+		return NewAny(r.Int63()-r.Int63(), nil)
+	case n == 1:
+		return NewAny(r.NormFloat64()*math.Pow(10, float64(r.Intn(60)-30)), nil)
+	case n == 2:
+		return NewAny(random("ab \"\\\n\t\r\x00;()é日", r.Intn(8)), nil)
+	case n == 3 || depth == 0:
+		return NewAny(Identifier(random(initials, 1)+random(runes, r.Intn(6))), nil)
+	case n == 4:
+		return NewAny([]interface{}{nil, true, false}[r.Intn(3)], nil)
+	default:
+		list := make([]Value, r.Intn(5))
+		for i := range list {
+			list[i] = randomValue(r, depth-1)
+		}
+		return NewAny(list, nil)
+	}
+}
+
+// equalValues compares the data of a and b, without their references. nil and
+// the booleans are equal to the identifiers they are written as.
+func equalValues(a, b Value) bool {
+	switch data := a.Value().(type) {
+	case nil, bool:
+		return b.Value() == Identifier(Format(a))
+	case []Value:
+		other, ok := b.Value().([]Value)
+		if !ok || len(data) != len(other) {
+			return false
+		}
+		for i := range data {
+			if !equalValues(data[i], other[i]) {
+				return false
+			}
+		}
+		return true
+	case float64:
+		other, ok := b.Value().(float64)
+		return ok && math.Float64bits(data) == math.Float64bits(other)
+	default:
+		return a.Value() == b.Value()
+	}
+}
+
+func TestFormatRoundTrip(t *testing.T) {
+	config := &quick.Config{
+		MaxCount: 2000,
+		Values: func(args []reflect.Value, r *rand.Rand) {
+			args[0] = reflect.ValueOf(randomValue(r, 4))
+		},
+	}
+	roundTrip := func(v Value) bool {
+		s := Format(v)
+		parsed, err := Parse(NewSource(s))
+		if err != nil {
+			t.Logf("Unable to parse %q: %v", s, err)
+			return false
+		}
+		if !equalValues(v, parsed) {
+			t.Logf("%q was parsed as %q", s, Format(parsed))
+			return false
+		}
+		return Format(parsed) == s
+	}
+	if err := quick.Check(roundTrip, config); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestParseCST(t *testing.T) {
+	valid := []string{
+		"",
+		"foo",
+		" (a  (b\tc)\n) ; comment\n",
+		"(a ; b\n c)\r\n",
+		"(a @b @ ; c\n (d) \"e \\\" f\")",
+		"(a\n\n  1.5 -2)(b)\n;",
+		"\"multi\nline\"",
+	}
+	for _, input := range valid {
+		root, err := ParseCST(NewSource(input))
+		if err != nil {
+			t.Errorf("Input %q - unexpected error: %v", input, err)
+			continue
+		}
+		if s := root.String(); s != input {
+			t.Errorf("Input %q - expected the same source, got %q", input, s)
+		}
+	}
+
+	root, _ := ParseCST(NewSource("(a ; b\n @c)"))
+	list := root.Children[0]
+	kinds := []NodeKind{NodeAtom, NodeSpace, NodeComment, NodeSpace, NodeDeref}
+	if list.Kind != NodeList || len(list.Children) != len(kinds) {
+		t.Fatalf("Unexpected tree: %#v", list)
+	}
+	for i, kind := range kinds {
+		if list.Children[i].Kind != kind {
+			t.Errorf("Expected kind %d for child %d, got %d", kind, i, list.Children[i].Kind)
+		}
+	}
+	if c := list.Children[2]; c.Text != "; b" || c.Ref.Line != 0 || c.Ref.Column != 3 {
+		t.Errorf("Unexpected comment %q at %d:%d", c.Text, c.Ref.Line, c.Ref.Column)
+	}
+
+	invalid := []string{"(a", "a)", `("abc)`, `"a\"`, "(@)", "@"}
+	for _, input := range invalid {
+		if _, err := ParseCST(NewSource(input)); err == nil {
+			t.Errorf("Input %q - expected an error", input)
+		}
+	}
+}
+
 func TestParsingErrors(t *testing.T) {
 	type foo struct {
 		code ErrorCode
@@ -212,3 +454,38 @@ func TestSourceRef(t *testing.T) {
 		(&ref).Context("  ")
 	}
 }
+
+// benchmarkSource returns a large program, made of n function definitions.
+func benchmarkSource(n int) string {
+	var b strings.Builder
+	b.WriteString("(package \"bench\"\n")
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(&b, "  ; function %d\n", i)
+		fmt.Fprintf(&b, "  (def f%d (n &optional (step 1.5))\n", i)
+		fmt.Fprintf(&b, "    (if (< n %d) \"small \\\"value\\\"\" (f%d (- n step) :key @acc)))\n", i, i)
+	}
+	b.WriteString(")\n")
+	return b.String()
+}
+
+func BenchmarkLexer(b *testing.B) {
+	src := NewSource(benchmarkSource(1000))
+	b.SetBytes(int64(len(src.data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		l := newLexer(src)
+		for l.Next().(tokenInfo).id != tokEOF {
+		}
+	}
+}
+
+func BenchmarkParse(b *testing.B) {
+	input := benchmarkSource(1000)
+	b.SetBytes(int64(len(input)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := Parse(NewSource(input)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package parser
+
+import (
+	"sync"
+)
+
+// Symbol is the interned form of an identifier: a small integer standing for
+// its name, cheaper to hash and compare than the name itself. The zero Symbol
+// is not the symbol of any name.
+//
+// All the symbols come from a single table, safe for concurrent use, so that
+// the values parsed and evaluated by different goroutines share them.
+type Symbol uint32
+
+// symbolTable maps names to symbols and back.
+type symbolTable struct {
+	mu    sync.RWMutex
+	ids   map[string]Symbol
+	names []string
+}
+
+var symbols = &symbolTable{
+	ids:   map[string]Symbol{},
+	names: []string{""},
+}
+
+// Intern returns the symbol of name, adding it to the symbol table if needed.
+func Intern(name string) Symbol {
+	symbols.mu.RLock()
+	s, ok := symbols.ids[name]
+	symbols.mu.RUnlock()
+	if ok {
+		return s
+	}
+
+	symbols.mu.Lock()
+	defer symbols.mu.Unlock()
+	if s, ok := symbols.ids[name]; ok {
+		return s
+	}
+	s = Symbol(len(symbols.names))
+	symbols.names = append(symbols.names, name)
+	symbols.ids[name] = s
+	return s
+}
+
+// Name returns the name s was interned from.
+func (s Symbol) Name() string {
+	symbols.mu.RLock()
+	defer symbols.mu.RUnlock()
+	return symbols.names[s]
+}
+
+func (s Symbol) String() string {
+	return s.Name()
+}
+
+// Symbol returns the interned form of the identifier.
+func (id Identifier) Symbol() Symbol {
+	return Intern(string(id))
+}
+
+// symbolValue is the value of an identifier which keeps its symbol, so that
+// it does not have to be interned again. It is a separate type to keep Any
+// small.
+type symbolValue struct {
+	Any
+	sym Symbol
+}
+
+// NewIdentifier creates the value of an identifier from its symbol.
+func NewIdentifier(s Symbol, ref *SourceRef) Value {
+	return symbolValue{
+		Any: Any{value: Identifier(s.Name()), ref: ref},
+		sym: s,
+	}
+}
+
+// SymbolOf returns the symbol of v, and whether v is an identifier.
+func SymbolOf(v Value) (Symbol, bool) {
+	if s, ok := v.(symbolValue); ok {
+		return s.sym, true
+	}
+	id, ok := v.Value().(Identifier)
+	if !ok {
+		return 0, false
+	}
+	return id.Symbol(), true
+}
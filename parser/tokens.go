@@ -14,10 +14,20 @@ const (
 	tokFloat
 	tokString
 	tokArray
+	tokDeref
+	tokSpace
+	tokComment
+	tokInvalidNumber
 )
 
 type tokenID int
 
+// Symbols of the forms generated by the prefixes of the syntax.
+var (
+	symArray = Intern("array")
+	symDeref = Intern("deref")
+)
+
 func (t tokenID) String() string {
 	switch t {
 	case tokEOF:
@@ -36,6 +46,14 @@ func (t tokenID) String() string {
 		return "String"
 	case tokArray:
 		return "Array"
+	case tokDeref:
+		return "Deref"
+	case tokSpace:
+		return "Space"
+	case tokComment:
+		return "Comment"
+	case tokInvalidNumber:
+		return "InvalidNumber"
 	default:
 		return fmt.Sprintf("Unknown[%d", t)
 	}
@@ -53,6 +71,9 @@ var tokenPriorities = map[tokenID]int{
 	tokFloat:      20,
 	tokString:     20,
 	tokArray:      20,
+	tokDeref:      20,
+	// Invalid numbers are parsed as any value, to be reported as errors.
+	tokInvalidNumber: 20,
 }
 
 // tokenInfo give details about a token the lexer extracted - including
@@ -67,7 +88,8 @@ type tokenInfo struct {
 	ref *SourceRef
 	// id is the lexer token ID, using tok* symbols.
 	id tokenID
-	// value is the parsed value of the token - can be a string, int, nil, ...
+	// value is the parsed value of the token - can be a string, int, nil, the
+	// Symbol of an identifier...
 	value interface{}
 }
 
@@ -82,11 +104,13 @@ func (t tokenInfo) Nud(ctx Context) interface{} {
 	// case tokClose: // Shoud never happen
 	case tokArray:
 		sublist := ctx.Expression(tokenPriorities[tokOpen]).([]Value)
-		array := NewAny(Identifier("array"), t.ref)
+		array := NewIdentifier(symArray, t.ref)
 		r := NewAny(append([]Value{array}, sublist...), t.ref)
 		return []Value{r}
+	case tokDeref:
+		return []Value{derefExpression(ctx, t)}
 	case tokIdentifier:
-		return []Value{NewAny(Identifier(t.value.(string)), t.ref)}
+		return []Value{NewIdentifier(t.value.(Symbol), t.ref)}
 	case tokInteger, tokFloat, tokString:
 		return []Value{NewAny(t.value, t.ref)}
 	case tokEOF:
@@ -103,6 +127,14 @@ func (t tokenInfo) Nud(ctx Context) interface{} {
 	return []Value{}
 }
 
+// derefExpression parses the expression following a @ prefix and wraps it
+// into (deref expression).
+func derefExpression(ctx Context, t tokenInfo) Value {
+	sublist := ctx.Expression(tokenPriorities[tokOpen]).([]Value)
+	deref := NewIdentifier(symDeref, t.ref)
+	return NewAny(append([]Value{deref}, sublist...), t.ref)
+}
+
 func ftokOpen(ctx Context) (sublist []Value) {
 	if ctx.Peek().(tokenInfo).id != tokClose {
 		sublist = ctx.Expression(tokenPriorities[tokClose]).([]Value)
@@ -131,11 +163,13 @@ func (t tokenInfo) Led(ctx Context, left interface{}) interface{} {
 	// case tokClose: // Should never happen.
 	case tokArray:
 		sublist := ctx.Expression(tokenPriorities[tokOpen]).([]Value)
-		array := NewAny(Identifier("array"), t.ref)
+		array := NewIdentifier(symArray, t.ref)
 		r := NewAny(append([]Value{array}, sublist...), t.ref)
 		return append(left.([]Value), r)
+	case tokDeref:
+		return append(left.([]Value), derefExpression(ctx, t))
 	case tokIdentifier:
-		return append(left.([]Value), NewAny(Identifier(t.value.(string)), t.ref))
+		return append(left.([]Value), NewIdentifier(t.value.(Symbol), t.ref))
 	case tokInteger, tokFloat, tokString:
 		return append(left.([]Value), NewAny(t.value, t.ref))
 	}
@@ -0,0 +1,189 @@
+package runtime
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/rumlang/rum/parser"
+)
+
+// Atom is a mutable reference to a value, safe to use from several
+// goroutines. Its value is changed with Reset or Swap, and can be checked by a
+// validator and observed by watchers.
+type Atom struct {
+	mu sync.Mutex
+	// version is incremented each time the value changes, to implement the
+	// compare and swap loop of Swap.
+	version   uint64
+	value     parser.Value
+	validator interface{}
+	watches   map[interface{}]interface{}
+}
+
+// NewAtom creates an atom holding v.
+func NewAtom(v parser.Value) *Atom {
+	return &Atom{value: v, watches: map[interface{}]interface{}{}}
+}
+
+func (a *Atom) String() string {
+	return PrString(a)
+}
+
+// Deref returns the current value of the atom.
+func (a *Atom) Deref() parser.Value {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.value
+}
+
+// validate panics if v is rejected by the validator of the atom.
+func (a *Atom) validate(validator interface{}, v parser.Value) {
+	if validator != nil && !Truthy(Apply(validator, v).Value()) {
+		panic(fmt.Sprintf("Invalid reference state: %v", v.Value()))
+	}
+}
+
+// set replaces the value of the atom if it was not changed since version was
+// read. It returns false otherwise.
+func (a *Atom) set(version uint64, v parser.Value) bool {
+	a.mu.Lock()
+	if a.version != version {
+		a.mu.Unlock()
+		return false
+	}
+	old := a.value
+	a.value = v
+	a.version++
+	watches := make(map[interface{}]interface{}, len(a.watches))
+	for key, fn := range a.watches {
+		watches[key] = fn
+	}
+	a.mu.Unlock()
+
+	for key, fn := range watches {
+		Apply(fn, parser.NewAny(key, nil), parser.NewAny(a, nil), old, v)
+	}
+	return true
+}
+
+// snapshot returns the current value, version and validator of the atom.
+func (a *Atom) snapshot() (parser.Value, uint64, interface{}) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.value, a.version, a.validator
+}
+
+// Reset sets the value of the atom to v, regardless of its current value.
+func (a *Atom) Reset(v parser.Value) parser.Value {
+	for {
+		_, version, validator := a.snapshot()
+		a.validate(validator, v)
+		if a.set(version, v) {
+			return v
+		}
+	}
+}
+
+// Swap sets the value of the atom to the result of fn on its current value.
+// If the atom is changed by another goroutine meanwhile, fn is called again
+// with the new value; fn must then be free of side effects.
+func (a *Atom) Swap(fn func(parser.Value) parser.Value) parser.Value {
+	for {
+		old, version, validator := a.snapshot()
+		v := fn(old)
+		a.validate(validator, v)
+		if a.set(version, v) {
+			return v
+		}
+	}
+}
+
+// CompareAndSet sets the value of the atom to v only if its current value is
+// equal to old. It reports whether the value was set.
+func (a *Atom) CompareAndSet(old, v parser.Value) bool {
+	current, version, validator := a.snapshot()
+	if !Equal(current.Value(), old.Value()) {
+		return false
+	}
+	a.validate(validator, v)
+	return a.set(version, v)
+}
+
+// mustAtom checks that v is an atom.
+func mustAtom(v interface{}) *Atom {
+	a, ok := v.(*Atom)
+	if !ok {
+		panic(fmt.Sprintf("Expected an atom, got %T", v))
+	}
+	return a
+}
+
+// AtomFn implements the atom function: (atom value) or
+// (atom value :validator fn).
+func AtomFn(v interface{}, options ...interface{}) *Atom {
+	a := NewAtom(parser.NewAny(v, nil))
+	for i := 0; i < len(options); i += 2 {
+		if options[i] != parser.Identifier(":validator") || i+1 >= len(options) {
+			panic(fmt.Sprintf("Invalid atom option %v", options[i]))
+		}
+		a.validate(options[i+1], a.value)
+		a.validator = options[i+1]
+	}
+	return a
+}
+
+// Deref implements the deref function, also available with the @ prefix.
+func Deref(a interface{}) interface{} {
+	return mustAtom(a).Deref().Value()
+}
+
+// ResetAtom implements the reset! function: (reset! atom value).
+func ResetAtom(a interface{}, v interface{}) interface{} {
+	return mustAtom(a).Reset(parser.NewAny(v, nil)).Value()
+}
+
+// SwapAtom implements the swap! function: (swap! atom fn args...). The new
+// value of the atom is (fn old args...).
+func SwapAtom(a interface{}, fn interface{}, args ...interface{}) interface{} {
+	return mustAtom(a).Swap(func(old parser.Value) parser.Value {
+		return Apply(fn, append([]parser.Value{old}, List(args...)...)...)
+	}).Value()
+}
+
+// CompareAndSetAtom implements the compare-and-set! function:
+// (compare-and-set! atom old new).
+func CompareAndSetAtom(a interface{}, old, v interface{}) bool {
+	return mustAtom(a).CompareAndSet(parser.NewAny(old, nil), parser.NewAny(v, nil))
+}
+
+// SetValidator implements the set-validator! function:
+// (set-validator! atom fn). fn is called with each new value and must return
+// true for the change to be accepted. nil removes the validator.
+func SetValidator(a interface{}, fn interface{}) {
+	atom := mustAtom(a)
+	if fn != nil {
+		atom.validate(fn, atom.Deref())
+	}
+	atom.mu.Lock()
+	defer atom.mu.Unlock()
+	atom.validator = fn
+}
+
+// AddWatch implements the add-watch function: (add-watch atom key fn). fn is
+// called with the key, the atom, the old and the new value after each change.
+func AddWatch(a interface{}, key interface{}, fn interface{}) interface{} {
+	atom := mustAtom(a)
+	atom.mu.Lock()
+	defer atom.mu.Unlock()
+	atom.watches[mapKey(key)] = fn
+	return atom
+}
+
+// RemoveWatch implements the remove-watch function: (remove-watch atom key).
+func RemoveWatch(a interface{}, key interface{}) interface{} {
+	atom := mustAtom(a)
+	atom.mu.Lock()
+	defer atom.mu.Unlock()
+	delete(atom.watches, mapKey(key))
+	return atom
+}
@@ -0,0 +1,170 @@
+package runtime
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/rumlang/rum/parser"
+)
+
+// Capability is a set of permissions to access the host, given to the scripts
+// evaluated in a context. Without any, only the core language is available.
+type Capability uint
+
+const (
+	// CapStdout allows using the standard streams of the context: printing to
+	// the output and error, and reading the input.
+	CapStdout Capability = 1 << iota
+	// CapFileRead allows reading the files under the allowed roots.
+	CapFileRead
+	// CapFileWrite allows writing the files under the allowed roots.
+	CapFileWrite
+	// CapEnv allows reading the environment variables.
+	CapEnv
+	// CapTime allows reading the clock and sleeping.
+	CapTime
+	// CapNetwork allows network requests.
+	CapNetwork
+	// CapExec allows running processes.
+	CapExec
+
+	// CapPure is the empty set: only the core language.
+	CapPure Capability = 0
+	// CapAll contains all the capabilities.
+	CapAll = CapStdout | CapFileRead | CapFileWrite | CapEnv | CapTime | CapNetwork | CapExec
+	// CapDefault are the capabilities of the contexts created by NewContext:
+	// only the standard streams. The libraries accessing the host need to be
+	// granted with NewContextWithOptions.
+	CapDefault = CapStdout
+)
+
+var capabilityNames = []string{"stdout", "fs-read", "fs-write", "env", "time", "network", "exec"}
+
+func (c Capability) String() string {
+	if c == CapPure {
+		return "pure"
+	}
+	var names []string
+	for i, name := range capabilityNames {
+		if c&(1<<uint(i)) != 0 {
+			names = append(names, name)
+		}
+	}
+	return strings.Join(names, "|")
+}
+
+// Options configures a context created by NewContextWithOptions.
+type Options struct {
+	// Capabilities are the permissions of the scripts.
+	Capabilities Capability
+	// Roots are the directories where files can be accessed with CapFileRead
+	// and CapFileWrite. No file can be accessed when it is empty.
+	Roots []string
+}
+
+// NewContextWithOptions creates a root context whose scripts can only access
+// the host through the capabilities of opts. The builtins and the libraries
+// which need other capabilities raise an *Error (code ErrCapability) when
+// they are used.
+func NewContextWithOptions(opts Options) *Context {
+	c := NewContext(nil)
+	c.capabilities = opts.Capabilities
+	for _, root := range opts.Roots {
+		c.roots = append(c.roots, resolvePath(root))
+	}
+
+	for id, capability := range guardedBuiltins {
+		if !c.HasCapability(capability) {
+			c.env[id.Symbol()] = parser.NewAny(denied(string(id), capability), nil)
+		}
+	}
+	c.bindIO()
+	return c
+}
+
+// guardedBuiltins are the builtins of the default context which need a
+// capability.
+var guardedBuiltins = map[parser.Identifier]Capability{
+	"fprintf": CapStdout,
+}
+
+// HasCapability reports whether the scripts evaluated in the context have
+// all the capabilities of capability.
+func (c *Context) HasCapability(capability Capability) bool {
+	return c.root().capabilities&capability == capability
+}
+
+// RequireCapability raises an *Error (code ErrCapability) if the context does
+// not have capability, which what needs. It is meant for the Go functions
+// accessing the host.
+func (c *Context) RequireCapability(capability Capability, what string) {
+	if !c.HasCapability(capability) {
+		panic(capabilityError(what, capability))
+	}
+}
+
+func capabilityError(what string, capability Capability) *Error {
+	return &Error{
+		Code: ErrCapability,
+		Msg:  fmt.Sprintf("capability denied: %s needs %s", what, capability),
+	}
+}
+
+// denied returns a function raising a capability error, defined instead of
+// the function named name.
+func denied(name string, capability Capability) func(...interface{}) interface{} {
+	return func(...interface{}) interface{} {
+		panic(capabilityError(name, capability))
+	}
+}
+
+// SetGuardedFn is similar to SetFn, but the function raises a capability
+// error instead when the context does not have capability.
+func (c *Context) SetGuardedFn(id parser.Identifier, capability Capability, v interface{}, adapters ...Adapter) {
+	if !c.HasCapability(capability) {
+		c.SetFn(id, denied(string(id), capability))
+		return
+	}
+	c.SetFn(id, v, adapters...)
+}
+
+// RequirePath raises a capability error if the context can not access path
+// with capability (CapFileRead or CapFileWrite): it must be under one of the
+// allowed roots, once the symbolic links are resolved.
+func (c *Context) RequirePath(capability Capability, path string) {
+	c.RequireCapability(capability, "access to "+path)
+	resolved := resolvePath(path)
+	for _, root := range c.root().roots {
+		rel, err := filepath.Rel(root, resolved)
+		if err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return
+		}
+	}
+	panic(&Error{
+		Code: ErrCapability,
+		Msg:  fmt.Sprintf("capability denied: %s is not under the allowed roots", path),
+	})
+}
+
+// resolvePath returns the absolute path of path with the symbolic links
+// resolved, for the longest part of it which exists.
+func resolvePath(path string) string {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return path
+	}
+	resolved, err := filepath.EvalSymlinks(abs)
+	if err == nil {
+		return resolved
+	}
+	if !os.IsNotExist(err) {
+		return abs
+	}
+	dir, base := filepath.Split(abs)
+	if dir == abs || base == "" {
+		return abs
+	}
+	return filepath.Join(resolvePath(filepath.Clean(dir)), base)
+}
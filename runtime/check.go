@@ -0,0 +1,177 @@
+package runtime
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/rumlang/rum/parser"
+)
+
+// Check reports the references of the program to global variables which are
+// neither defined in its context nor by the program itself, as an *Error
+// (code ErrUnknownVariable). Run calls it before executing anything.
+//
+// Local variables are resolved to slots by Compile, so only the global
+// references are left to check. The forms evaluated by the interpreter are not
+// checked, but the variables they define are taken into account; Check
+// reports nothing if the program uses eval, which can define anything.
+func (p *Program) Check() error {
+	a := &analysis{
+		ctx:      p.main.ctx,
+		defined:  map[parser.Symbol]bool{},
+		prefixes: map[string]bool{},
+	}
+	a.definitions(p.main.proto)
+	if a.dynamic {
+		return nil
+	}
+
+	var refs []parser.Value
+	a.references(p.main.proto, &refs)
+	if len(refs) == 0 {
+		return nil
+	}
+	sort.SliceStable(refs, func(i, j int) bool {
+		a, b := refs[i].Ref(), refs[j].Ref()
+		if a == nil || b == nil {
+			return a != nil
+		}
+		return a.Line < b.Line || (a.Line == b.Line && a.Column < b.Column)
+	})
+
+	msgs := make([]string, len(refs))
+	for i, ref := range refs {
+		msgs[i] = fmt.Sprintf("%q does not exist", string(ref.Value().(parser.Identifier)))
+		if r := ref.Ref(); r != nil {
+			msgs[i] += fmt.Sprintf(" (line %d, col %d)", r.Line+1, r.Column+1)
+		}
+	}
+	return &Error{
+		Code:  ErrUnknownVariable,
+		Msg:   strings.Join(msgs, "; "),
+		Stack: refs[:1],
+	}
+}
+
+// analysis collects the global variables a program defines.
+type analysis struct {
+	ctx     *Context
+	defined map[parser.Symbol]bool
+	// prefixes contains the prefixes of the names defined by imports.
+	prefixes map[string]bool
+	// dynamic is true when the program can define variables which are not
+	// known before its execution.
+	dynamic bool
+}
+
+func (a *analysis) isDefined(sym parser.Symbol) bool {
+	if a.defined[sym] {
+		return true
+	}
+	if _, ok := a.ctx.lookup(sym); ok {
+		return true
+	}
+	if name := sym.Name(); strings.Index(name, ".") > 0 {
+		return a.prefixes[name[:strings.Index(name, ".")]]
+	}
+	return false
+}
+
+// references appends to refs the sources of the global references of p which
+// are not defined.
+func (a *analysis) references(p *proto, refs *[]parser.Value) {
+	for pc, in := range p.code {
+		if in.op == opGlobal && !a.isDefined(p.names[in.a]) {
+			*refs = append(*refs, p.sources[pc])
+		}
+	}
+	for _, child := range p.protos {
+		a.references(child, refs)
+	}
+}
+
+// definitions collects the variables defined by the compiled code of p and
+// by the forms it evaluates with the interpreter.
+func (a *analysis) definitions(p *proto) {
+	for _, in := range p.code {
+		switch in.op {
+		case opDefine:
+			a.defined[p.names[in.a]] = true
+		case opEval:
+			a.form(p.consts[in.a])
+		}
+	}
+	for _, child := range p.protos {
+		a.definitions(child)
+	}
+}
+
+// form collects the variables defined by v and its sub-expressions. It may
+// find more definitions than the evaluation of v actually makes (e.g., in a
+// nested scope), which only hides references from Check.
+func (a *analysis) form(v parser.Value) {
+	data, ok := v.Value().([]parser.Value)
+	if !ok {
+		return
+	}
+	for _, elt := range data {
+		a.form(elt)
+	}
+	if len(data) < 2 {
+		return
+	}
+	sym, ok := parser.SymbolOf(data[0])
+	if !ok {
+		return
+	}
+	fn, ok := a.ctx.lookup(sym)
+	if !ok {
+		return
+	}
+	internal, ok := fn.Value().(Internal)
+	if !ok {
+		return
+	}
+
+	args := data[1:]
+	name, _ := args[0].Value().(parser.Identifier)
+	switch funcPointer(internal) {
+	case funcPointer(Def), funcPointer(Let), funcPointer(DefMulti):
+		a.defined[name.Symbol()] = true
+	case funcPointer(DefRecord):
+		a.defined[name.Symbol()] = true
+		a.defined[(name + "?").Symbol()] = true
+		if len(args) > 1 {
+			fields, _ := args[1].Value().([]parser.Value)
+			for _, field := range fields {
+				if f, ok := field.Value().(parser.Identifier); ok {
+					a.defined[parser.Intern(fmt.Sprintf("%s-%s", name, f))] = true
+				}
+			}
+		}
+	case funcPointer(DefProtocol):
+		a.defined[name.Symbol()] = true
+		for _, arg := range args[1:] {
+			spec := arg
+			if elts, ok := arg.Value().([]parser.Value); ok && len(elts) > 0 {
+				spec = elts[0]
+			}
+			if method, ok := spec.Value().(parser.Identifier); ok {
+				a.defined[method.Symbol()] = true
+			}
+		}
+	case funcPointer(Import):
+		for _, arg := range args {
+			pkg, ok := arg.Value().(parser.Identifier)
+			if elts, isList := arg.Value().([]parser.Value); isList && len(elts) > 0 {
+				pkg, ok = elts[0].Value().(parser.Identifier)
+			}
+			if ok {
+				a.prefixes[string(pkg)] = true
+			}
+		}
+	case funcPointer(Eval):
+		a.dynamic = true
+	}
+}
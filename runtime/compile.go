@@ -0,0 +1,620 @@
+package runtime
+
+import (
+	"reflect"
+	"strings"
+
+	"github.com/rumlang/rum/parser"
+)
+
+// Compile compiles the expression v to bytecode, to be executed with Run in
+// the context ctx. Variables are resolved statically: local variables to
+// slots of the frame, the variables of enclosing functions to values captured
+// by the closure, and the others to global variables, which Run checks before
+// execution. The builtins of the default context are called directly.
+//
+// Top-level forms which the compiler does not support (e.g., match or
+// destructuring) are evaluated by the interpreter instead, so any expression
+// can be compiled.
+//
+// Only the compiled programs use the resolved variables and the check of the
+// global references. TryEval, MustEval and the REPL keep the interpreter,
+// which looks each reference up in the chain of contexts and reports an
+// unknown variable when it is evaluated.
+func Compile(ctx *Context, v parser.Value) *Program {
+	c := &compiler{ctx: ctx, proto: &proto{}, redefined: map[parser.Identifier]bool{}}
+	redefinitions(v, c.redefined)
+	c.expr(v, true, nil)
+	c.emit(opReturn, 0, 0, v)
+	return &Program{main: &Closure{proto: c.proto, ctx: ctx}}
+}
+
+// unsupported is raised by the compiler, through panic, on a form it can not
+// compile.
+type unsupported struct {
+	v parser.Value
+}
+
+// compiler compiles the code of a function or of a top-level expression.
+type compiler struct {
+	ctx   *Context
+	proto *proto
+	// parent is the compiler of the enclosing function, nil at the top-level.
+	parent *compiler
+	// scope contains the local variables in scope; nil at the top-level,
+	// outside of any let.
+	scope *scope
+	// free maps the captured variables to their index in the closure.
+	free map[parser.Identifier]int
+	// redefined contains the global names defined by the program. Only used
+	// at the top-level.
+	redefined map[parser.Identifier]bool
+}
+
+// scope maps the names of local variables to their slot.
+type scope struct {
+	names  map[parser.Identifier]int
+	parent *scope
+}
+
+// recurTarget is where recur jumps to, after setting the provided slots.
+type recurTarget struct {
+	slots []int
+	pc    int
+}
+
+func (c *compiler) emit(op opcode, a, b int, source parser.Value) int {
+	c.proto.code = append(c.proto.code, instr{op: op, a: int32(a), b: int32(b)})
+	c.proto.sources = append(c.proto.sources, source)
+	return len(c.proto.code) - 1
+}
+
+// patch sets the target of the jump at pc to the next instruction.
+func (c *compiler) patch(pc int) {
+	c.proto.code[pc].a = int32(len(c.proto.code))
+}
+
+func (c *compiler) constant(v parser.Value, source parser.Value) {
+	c.proto.consts = append(c.proto.consts, v)
+	c.emit(opConst, len(c.proto.consts)-1, 0, source)
+}
+
+func (c *compiler) name(id parser.Identifier) int {
+	sym := id.Symbol()
+	for i, name := range c.proto.names {
+		if name == sym {
+			return i
+		}
+	}
+	c.proto.names = append(c.proto.names, sym)
+	return len(c.proto.names) - 1
+}
+
+// slot allocates a new local slot for id in the current scope.
+func (c *compiler) slot(id parser.Identifier) int {
+	c.scope.names[id] = c.proto.locals
+	c.proto.locals++
+	return c.proto.locals - 1
+}
+
+// popScope restores the scope saved before pushScope, even when the form
+// is not supported.
+func (c *compiler) popScope(saved *scope) {
+	c.scope = saved
+}
+
+func (c *compiler) pushScope() {
+	c.scope = &scope{names: map[parser.Identifier]int{}, parent: c.scope}
+}
+
+// resolve returns the instruction loading the local variable id, capturing
+// it from the enclosing functions if needed. It returns false for global
+// variables.
+func (c *compiler) resolve(id parser.Identifier) (opcode, int, bool) {
+	for s := c.scope; s != nil; s = s.parent {
+		if i, ok := s.names[id]; ok {
+			return opLocal, i, true
+		}
+	}
+	if i, ok := c.free[id]; ok {
+		return opFree, i, true
+	}
+	if c.parent == nil {
+		return 0, 0, false
+	}
+	op, index, ok := c.parent.resolve(id)
+	if !ok {
+		return 0, 0, false
+	}
+	c.proto.captures = append(c.proto.captures, capture{local: op == opLocal, index: index})
+	c.free[id] = len(c.proto.captures) - 1
+	return opFree, len(c.proto.captures) - 1, true
+}
+
+// expr compiles v. tail is true when v is in tail position of a function,
+// and recur is the target of recur when it can be used in v.
+func (c *compiler) expr(v parser.Value, tail bool, recur *recurTarget) {
+	if c.parent == nil && c.scope == nil {
+		// No local variable can be used at this point: forms which are not
+		// supported can be evaluated by the interpreter.
+		defer c.fallback(v, len(c.proto.code))
+	}
+
+	switch data := v.Value().(type) {
+	case []parser.Value:
+		if len(data) == 0 {
+			c.constant(parser.NewAny(nil, nil), v)
+			return
+		}
+		if id, ok := data[0].Value().(parser.Identifier); ok {
+			if _, _, local := c.resolve(id); !local {
+				if fn, ok := c.ctx.lookup(id.Symbol()); ok {
+					internal, special := fn.Value().(Internal)
+					switch {
+					case special && c.redefines(id):
+						// The special form might be replaced by a function
+						// when the call is evaluated.
+						panic(&unsupported{v})
+					case special:
+						c.special(internal, v, data[1:], tail, recur)
+						return
+					}
+					if i, ok := builtinIndex(id, fn.Value()); ok && !c.redefines(id) {
+						for _, arg := range data[1:] {
+							c.expr(arg, false, nil)
+						}
+						c.emit(opBuiltin, i, len(data)-1, v)
+						return
+					}
+				}
+			}
+		}
+		for _, elt := range data {
+			c.expr(elt, false, nil)
+		}
+		op := opCall
+		if tail {
+			op = opTailCall
+		}
+		c.emit(op, len(data)-1, 0, v)
+	case parser.Identifier:
+		if IsKeyword(data) {
+			c.constant(v, v)
+			return
+		}
+		if op, i, ok := c.resolve(data); ok {
+			c.emit(op, i, 0, v)
+			return
+		}
+		c.emit(opGlobal, c.name(data), 0, v)
+	default:
+		c.constant(v, v)
+	}
+}
+
+// fallback replaces the code compiled from v, starting at pc, with its
+// evaluation by the interpreter when v is not supported.
+func (c *compiler) fallback(v parser.Value, pc int) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	if _, ok := r.(*unsupported); !ok {
+		panic(r)
+	}
+	c.proto.code = c.proto.code[:pc]
+	c.proto.sources = c.proto.sources[:pc]
+	c.proto.consts = append(c.proto.consts, v)
+	c.emit(opEval, len(c.proto.consts)-1, 0, nil)
+}
+
+// body compiles a list of expressions, keeping the value of the last one.
+func (c *compiler) body(body []parser.Value, tail bool, recur *recurTarget, source parser.Value) {
+	if len(body) == 0 {
+		c.constant(parser.NewAny(nil, nil), source)
+		return
+	}
+	for _, v := range body[:len(body)-1] {
+		c.expr(v, false, nil)
+		c.emit(opPop, 0, 0, v)
+	}
+	c.expr(body[len(body)-1], tail, recur)
+}
+
+// builtinIndex returns the index of the builtin named id, if fn is still the
+// default implementation.
+func builtinIndex(id parser.Identifier, fn interface{}) (int, bool) {
+	for i, b := range builtins {
+		if b.name == id {
+			return i, funcPointer(fn) == funcPointer(b.fn)
+		}
+	}
+	return 0, false
+}
+
+func funcPointer(fn interface{}) uintptr {
+	v := reflect.ValueOf(fn)
+	if v.Kind() != reflect.Func {
+		return 0
+	}
+	return v.Pointer()
+}
+
+type specialCompiler func(c *compiler, v parser.Value, args []parser.Value, tail bool, recur *recurTarget)
+
+var specialCompilers map[uintptr]specialCompiler
+
+func init() {
+	specialCompilers = map[uintptr]specialCompiler{
+		funcPointer(Array):   (*compiler).compileArray,
+		funcPointer(If):      (*compiler).compileIf,
+		funcPointer(When):    conditional(opJumpFalse),
+		funcPointer(Unless):  conditional(opJumpTrue),
+		funcPointer(And):     shortCircuit(opAndJump, parser.NewAny(true, nil)),
+		funcPointer(Or):      shortCircuit(opOrJump, parser.NewAny(nil, nil)),
+		funcPointer(Cond):    (*compiler).compileCond,
+		funcPointer(Do):      (*compiler).compileDo,
+		funcPointer(Let):     (*compiler).compileLet,
+		funcPointer(LetStar): (*compiler).compileLetStar,
+		funcPointer(Loop):    (*compiler).compileLoop,
+		funcPointer(Recur):   (*compiler).compileRecur,
+		funcPointer(Lambda):  (*compiler).compileLambda,
+		funcPointer(Def):     (*compiler).compileDef,
+	}
+}
+
+// special compiles the special form internal.
+func (c *compiler) special(internal Internal, v parser.Value, args []parser.Value, tail bool, recur *recurTarget) {
+	compile, ok := specialCompilers[funcPointer(internal)]
+	if !ok {
+		panic(&unsupported{v})
+	}
+	compile(c, v, args, tail, recur)
+}
+
+func (c *compiler) compileArray(v parser.Value, args []parser.Value, tail bool, recur *recurTarget) {
+	if len(args) != 1 {
+		panic(&unsupported{v})
+	}
+	c.constant(args[0], v)
+}
+
+func (c *compiler) compileIf(v parser.Value, args []parser.Value, tail bool, recur *recurTarget) {
+	if len(args) < 2 || len(args) > 3 {
+		panic(&unsupported{v})
+	}
+	c.expr(args[0], false, nil)
+	jumpFalse := c.emit(opJumpFalse, 0, 0, v)
+	c.expr(args[1], tail, recur)
+	jump := c.emit(opJump, 0, 0, v)
+	c.patch(jumpFalse)
+	c.body(args[2:], tail, recur, v)
+	c.patch(jump)
+}
+
+// conditional compiles when, with opJumpFalse, and unless, with opJumpTrue.
+func conditional(op opcode) specialCompiler {
+	return func(c *compiler, v parser.Value, args []parser.Value, tail bool, recur *recurTarget) {
+		if len(args) < 1 {
+			panic(&unsupported{v})
+		}
+		c.expr(args[0], false, nil)
+		skip := c.emit(op, 0, 0, v)
+		c.body(args[1:], tail, recur, v)
+		jump := c.emit(opJump, 0, 0, v)
+		c.patch(skip)
+		c.constant(parser.NewAny(nil, nil), v)
+		c.patch(jump)
+	}
+}
+
+// shortCircuit compiles and, with opAndJump, and or, with opOrJump. empty is
+// the value without arguments.
+func shortCircuit(op opcode, empty parser.Value) specialCompiler {
+	return func(c *compiler, v parser.Value, args []parser.Value, tail bool, recur *recurTarget) {
+		if len(args) == 0 {
+			c.constant(empty, v)
+			return
+		}
+		var jumps []int
+		for _, arg := range args[:len(args)-1] {
+			c.expr(arg, false, nil)
+			jumps = append(jumps, c.emit(op, 0, 0, arg))
+		}
+		c.expr(args[len(args)-1], tail, recur)
+		for _, jump := range jumps {
+			c.patch(jump)
+		}
+	}
+}
+
+func (c *compiler) compileCond(v parser.Value, args []parser.Value, tail bool, recur *recurTarget) {
+	var jumps []int
+	for _, arg := range args {
+		clause, ok := arg.Value().([]parser.Value)
+		if !ok || len(clause) == 0 {
+			panic(&unsupported{v})
+		}
+		if isElse(clause[0]) {
+			c.body(clause[1:], tail, recur, arg)
+			for _, jump := range jumps {
+				c.patch(jump)
+			}
+			return
+		}
+		c.expr(clause[0], false, nil)
+		if len(clause) == 1 {
+			jumps = append(jumps, c.emit(opOrJump, 0, 0, arg))
+			continue
+		}
+		next := c.emit(opJumpFalse, 0, 0, arg)
+		c.body(clause[1:], tail, recur, arg)
+		jumps = append(jumps, c.emit(opJump, 0, 0, arg))
+		c.patch(next)
+	}
+	c.constant(parser.NewAny(nil, nil), v)
+	for _, jump := range jumps {
+		c.patch(jump)
+	}
+}
+
+func (c *compiler) compileDo(v parser.Value, args []parser.Value, tail bool, recur *recurTarget) {
+	c.body(args, tail, recur, v)
+}
+
+// identifier returns v if it is a plain identifier, usable as a local
+// variable. Other patterns are not supported.
+func identifier(v parser.Value) parser.Identifier {
+	id, ok := v.Value().(parser.Identifier)
+	if !ok || IsKeyword(id) || strings.HasPrefix(string(id), "&") || id == "_" {
+		panic(&unsupported{v})
+	}
+	return id
+}
+
+// bindings returns the names and expressions of the bindings of a scoped let
+// or loop, which must be plain identifiers.
+func bindings(v parser.Value, list parser.Value) ([]parser.Identifier, []parser.Value) {
+	elts, ok := list.Value().([]parser.Value)
+	if !ok {
+		panic(&unsupported{v})
+	}
+	var names []parser.Identifier
+	var exprs []parser.Value
+	for _, elt := range elts {
+		pair, ok := elt.Value().([]parser.Value)
+		if !ok || len(pair) != 2 {
+			panic(&unsupported{v})
+		}
+		names = append(names, identifier(pair[0]))
+		exprs = append(exprs, pair[1])
+	}
+	return names, exprs
+}
+
+// compileLet compiles the definition form of let: (let name expr). At the
+// top-level, it defines a variable of the context; otherwise a local
+// variable of the current scope.
+func (c *compiler) compileLet(v parser.Value, args []parser.Value, tail bool, recur *recurTarget) {
+	if len(args) >= 1 {
+		if _, ok := args[0].Value().([]parser.Value); ok {
+			c.compileLetScoped(v, args, tail, recur)
+			return
+		}
+	}
+	if len(args) != 2 {
+		panic(&unsupported{v})
+	}
+	id := identifier(args[0])
+	if c.scope != nil && refersTo(args[1], id) {
+		// A local variable is resolved before it is defined, and closures
+		// capture the values of the variables: a function bound by let can not
+		// refer to itself, as the interpreter allows.
+		panic(&unsupported{v})
+	}
+	c.expr(args[1], false, nil)
+	if c.scope == nil {
+		c.emit(opDefine, c.name(id), 1, v)
+		return
+	}
+	if _, ok := c.scope.names[id]; ok {
+		// Redefinitions are reported by the interpreter.
+		panic(&unsupported{v})
+	}
+	c.emit(opStore, c.slot(id), 0, v)
+	c.emit(opLocal, c.scope.names[id], 0, v)
+}
+
+// redefines reports whether the program defines the global name id, whose
+// value at compile time can then not be relied upon.
+func (c *compiler) redefines(id parser.Identifier) bool {
+	for c.parent != nil {
+		c = c.parent
+	}
+	return c.redefined[id]
+}
+
+// redefinitions adds the global names defined by the forms of v to names.
+func redefinitions(v parser.Value, names map[parser.Identifier]bool) {
+	data, ok := v.Value().([]parser.Value)
+	if !ok || len(data) == 0 {
+		return
+	}
+	for _, elt := range data {
+		redefinitions(elt, names)
+	}
+	head, _ := data[0].Value().(parser.Identifier)
+	if len(data) < 2 {
+		return
+	}
+	name, ok := data[1].Value().(parser.Identifier)
+	switch {
+	case !ok:
+	case head == "def" || head == "let" || head == "set!" || head == "defmulti":
+		names[name] = true
+	case (head == "defrecord" || head == "defstruct") && len(data) > 2:
+		names[name] = true
+		names[name+"?"] = true
+		fields, _ := data[2].Value().([]parser.Value)
+		for _, field := range fields {
+			if id, ok := field.Value().(parser.Identifier); ok {
+				names[name+"-"+id] = true
+			}
+		}
+	case head == "defprotocol":
+		for _, method := range data[2:] {
+			if m, ok := method.Value().([]parser.Value); ok && len(m) > 0 {
+				if id, ok := m[0].Value().(parser.Identifier); ok {
+					names[id] = true
+				}
+			}
+		}
+	}
+}
+
+// refersTo reports whether the identifier id appears in v.
+func refersTo(v parser.Value, id parser.Identifier) bool {
+	switch data := v.Value().(type) {
+	case parser.Identifier:
+		return data == id
+	case []parser.Value:
+		for _, elt := range data {
+			if refersTo(elt, id) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (c *compiler) compileLetScoped(v parser.Value, args []parser.Value, tail bool, recur *recurTarget) {
+	if len(args) < 1 {
+		panic(&unsupported{v})
+	}
+	names, exprs := bindings(v, args[0])
+	for _, expr := range exprs {
+		c.expr(expr, false, nil)
+	}
+	defer c.popScope(c.scope)
+	c.pushScope()
+	slots := make([]int, len(names))
+	for i, name := range names {
+		slots[i] = c.slot(name)
+	}
+	for i := len(slots) - 1; i >= 0; i-- {
+		c.emit(opStore, slots[i], 0, v)
+	}
+	c.body(args[1:], tail, recur, v)
+}
+
+func (c *compiler) compileLetStar(v parser.Value, args []parser.Value, tail bool, recur *recurTarget) {
+	if len(args) < 1 {
+		panic(&unsupported{v})
+	}
+	names, exprs := bindings(v, args[0])
+	defer c.popScope(c.scope)
+	c.pushScope()
+	for i, name := range names {
+		c.expr(exprs[i], false, nil)
+		c.emit(opStore, c.slot(name), 0, v)
+	}
+	c.body(args[1:], tail, recur, v)
+}
+
+func (c *compiler) compileLoop(v parser.Value, args []parser.Value, tail bool, recur *recurTarget) {
+	if len(args) < 1 {
+		panic(&unsupported{v})
+	}
+	names, exprs := bindings(v, args[0])
+	for _, expr := range exprs {
+		c.expr(expr, false, nil)
+	}
+	defer c.popScope(c.scope)
+	c.pushScope()
+	target := &recurTarget{slots: make([]int, len(names))}
+	for i, name := range names {
+		target.slots[i] = c.slot(name)
+	}
+	for i := len(target.slots) - 1; i >= 0; i-- {
+		c.emit(opStore, target.slots[i], 0, v)
+	}
+	target.pc = len(c.proto.code)
+	c.body(args[1:], tail, target, v)
+}
+
+// compileRecur compiles recur, only supported in tail position of a loop or
+// a function with the right number of arguments.
+func (c *compiler) compileRecur(v parser.Value, args []parser.Value, tail bool, recur *recurTarget) {
+	if recur == nil || len(args) != len(recur.slots) {
+		panic(&unsupported{v})
+	}
+	for _, arg := range args {
+		c.expr(arg, false, nil)
+	}
+	for i := len(recur.slots) - 1; i >= 0; i-- {
+		c.emit(opStore, recur.slots[i], 0, v)
+	}
+	c.emit(opJump, recur.pc, 0, v)
+}
+
+func (c *compiler) compileLambda(v parser.Value, args []parser.Value, tail bool, recur *recurTarget) {
+	c.function(v, "", args)
+}
+
+// compileDef compiles def at the top-level; within functions, the defined
+// function can be recursive, which needs the interpreter.
+func (c *compiler) compileDef(v parser.Value, args []parser.Value, tail bool, recur *recurTarget) {
+	if len(args) < 2 || c.scope != nil {
+		panic(&unsupported{v})
+	}
+	id := identifier(args[0])
+	c.function(v, string(id), args[1:])
+	c.emit(opDefine, c.name(id), 0, v)
+}
+
+// function compiles a function with a single arity and plain parameters:
+// (params... & rest) body...
+func (c *compiler) function(v parser.Value, name string, args []parser.Value) {
+	if len(args) < 1 || isMultiArity(args) {
+		panic(&unsupported{v})
+	}
+	params, ok := args[0].Value().([]parser.Value)
+	if !ok {
+		panic(&unsupported{v})
+	}
+
+	fc := &compiler{
+		ctx:    c.ctx,
+		proto:  &proto{name: name},
+		parent: c,
+		free:   map[parser.Identifier]int{},
+	}
+	fc.pushScope()
+	target := &recurTarget{}
+	for i := 0; i < len(params); i++ {
+		if id, ok := params[i].Value().(parser.Identifier); ok && id == "&" {
+			if i != len(params)-2 {
+				panic(&unsupported{v})
+			}
+			fc.slot(identifier(params[i+1]))
+			fc.proto.rest = true
+			// recur would need to handle the rest arguments.
+			target = nil
+			break
+		}
+		id := identifier(params[i])
+		if _, ok := fc.scope.names[id]; ok {
+			panic(&unsupported{v})
+		}
+		slot := fc.slot(id)
+		fc.proto.params++
+		if target != nil {
+			target.slots = append(target.slots, slot)
+		}
+	}
+	fc.body(args[1:], true, target, v)
+	fc.emit(opReturn, 0, 0, v)
+
+	c.proto.protos = append(c.proto.protos, fc.proto)
+	c.emit(opClosure, len(c.proto.protos)-1, 0, v)
+}
@@ -0,0 +1,334 @@
+package runtime
+
+import (
+	"fmt"
+
+	"github.com/rumlang/rum/parser"
+)
+
+// Truthy reports whether v is considered true by conditional forms. Only nil
+// and false are false; every other value, including 0 and "", is true.
+func Truthy(v interface{}) bool {
+	switch data := v.(type) {
+	case nil:
+		return false
+	case bool:
+		return data
+	default:
+		return true
+	}
+}
+
+// evalBody evaluates all the provided expressions in order and returns the
+// value of the last one - or nil if there is none.
+func evalBody(ctx *Context, body []parser.Value) parser.Value {
+	result := parser.NewAny(nil, nil)
+	for _, v := range body {
+		result = ctx.MustEval(v)
+	}
+	return result
+}
+
+// recurBody is similar to evalBody, but the value of the last expression can
+// be the one of a recur, for the loops and functions to evaluate body again.
+func recurBody(ctx *Context, body []parser.Value) parser.Value {
+	if len(body) == 0 {
+		return parser.NewAny(nil, nil)
+	}
+	for _, v := range body[:len(body)-1] {
+		ctx.MustEval(v)
+	}
+	return ctx.evalRecur(body[len(body)-1])
+}
+
+// tailBody is similar to evalBody but returns the last expression as a tail
+// call. It must only be used by special forms returning its result directly.
+func tailBody(ctx *Context, body []parser.Value) parser.Value {
+	if len(body) == 0 {
+		return parser.NewAny(nil, nil)
+	}
+	for _, v := range body[:len(body)-1] {
+		ctx.MustEval(v)
+	}
+	return ctx.tail(body[len(body)-1])
+}
+
+// isElse reports whether v is the 'else' catch-all marker of cond and case
+// clauses.
+func isElse(v parser.Value) bool {
+	id, ok := v.Value().(parser.Identifier)
+	return ok && id == "else"
+}
+
+// And implements the 'and' special form. It evaluates its arguments from left
+// to right and stops at the first false one, returning it. Otherwise, the last
+// value is returned; (and) is true.
+func And(ctx *Context, args ...parser.Value) parser.Value {
+	if len(args) == 0 {
+		return parser.NewAny(true, nil)
+	}
+	for _, arg := range args[:len(args)-1] {
+		result := ctx.MustEval(arg)
+		if !Truthy(result.Value()) {
+			return result
+		}
+	}
+	return ctx.tail(args[len(args)-1])
+}
+
+// Or implements the 'or' special form. It evaluates its arguments from left
+// to right and stops at the first true one, returning it. Otherwise, the last
+// value is returned; (or) is nil.
+func Or(ctx *Context, args ...parser.Value) parser.Value {
+	if len(args) == 0 {
+		return parser.NewAny(nil, nil)
+	}
+	for _, arg := range args[:len(args)-1] {
+		result := ctx.MustEval(arg)
+		if Truthy(result.Value()) {
+			return result
+		}
+	}
+	return ctx.tail(args[len(args)-1])
+}
+
+// Not implements the not function.
+func Not(v interface{}) bool {
+	return !Truthy(v)
+}
+
+// Cond implements the 'cond' special form:
+//
+//	(cond (test body...) ... (else body...))
+//
+// The body of the first clause whose test is true is evaluated. A clause
+// without body returns the value of its test. Returns nil when no clause
+// matches.
+func Cond(ctx *Context, args ...parser.Value) parser.Value {
+	for _, arg := range args {
+		clause, ok := arg.Value().([]parser.Value)
+		if !ok || len(clause) == 0 {
+			panic(fmt.Sprintf("Invalid cond clause: %s", arg))
+		}
+		if isElse(clause[0]) {
+			return tailBody(ctx, clause[1:])
+		}
+		test := ctx.MustEval(clause[0])
+		if !Truthy(test.Value()) {
+			continue
+		}
+		if len(clause) == 1 {
+			return test
+		}
+		return tailBody(ctx, clause[1:])
+	}
+	return parser.NewAny(nil, nil)
+}
+
+// Case implements the 'case' special form:
+//
+//	(case expr (key body...) ((key1 key2) body...) ... (else body...))
+//
+// The keys are not evaluated; the body of the first clause with a key equal
+// to the value of expr is evaluated. Returns nil when no clause matches.
+func Case(ctx *Context, args ...parser.Value) parser.Value {
+	if len(args) < 1 {
+		panic("Invalid arguments")
+	}
+
+	v := ctx.MustEval(args[0]).Value()
+	for _, arg := range args[1:] {
+		clause, ok := arg.Value().([]parser.Value)
+		if !ok || len(clause) == 0 {
+			panic(fmt.Sprintf("Invalid case clause: %s", arg))
+		}
+		if isElse(clause[0]) {
+			return tailBody(ctx, clause[1:])
+		}
+		keys := []parser.Value{clause[0]}
+		if list, ok := clause[0].Value().([]parser.Value); ok {
+			keys = list
+		}
+		for _, key := range keys {
+			if Equal(key.Value(), v) {
+				return tailBody(ctx, clause[1:])
+			}
+		}
+	}
+	return parser.NewAny(nil, nil)
+}
+
+// When implements the 'when' special form: (when test body...). The body is
+// only evaluated if test is true; otherwise nil is returned.
+func When(ctx *Context, args ...parser.Value) parser.Value {
+	if len(args) < 1 {
+		panic("Invalid arguments")
+	}
+	if !Truthy(ctx.MustEval(args[0]).Value()) {
+		return parser.NewAny(nil, nil)
+	}
+	return tailBody(ctx, args[1:])
+}
+
+// Unless implements the 'unless' special form: (unless test body...). The
+// body is only evaluated if test is false; otherwise nil is returned.
+func Unless(ctx *Context, args ...parser.Value) parser.Value {
+	if len(args) < 1 {
+		panic("Invalid arguments")
+	}
+	if Truthy(ctx.MustEval(args[0]).Value()) {
+		return parser.NewAny(nil, nil)
+	}
+	return tailBody(ctx, args[1:])
+}
+
+// Do implements the 'do' (or 'begin') special form: it evaluates all its
+// arguments in order and returns the value of the last one.
+func Do(ctx *Context, args ...parser.Value) parser.Value {
+	return tailBody(ctx, args)
+}
+
+// binding is a pattern/expression pair from the binding list of a scoped let.
+type binding struct {
+	pattern parser.Value
+	expr    parser.Value
+}
+
+// letBindings extracts the bindings of a scoped let form: ((pattern expr)...).
+func letBindings(v parser.Value) []binding {
+	list, ok := v.Value().([]parser.Value)
+	if !ok {
+		panic(fmt.Sprintf("Invalid let bindings: %s", v))
+	}
+	var bindings []binding
+	for _, b := range list {
+		pair, ok := b.Value().([]parser.Value)
+		if !ok || len(pair) != 2 {
+			panic(fmt.Sprintf("Invalid let binding: %s", b))
+		}
+		bindings = append(bindings, binding{pattern: pair[0], expr: pair[1]})
+	}
+	return bindings
+}
+
+// LetScoped implements the scoped form of let:
+//
+//	(let ((pattern expr)...) body...)
+//
+// All expressions are evaluated in the current context, then the body is
+// evaluated in a child context where the patterns are bound.
+func LetScoped(ctx *Context, args ...parser.Value) parser.Value {
+	if len(args) < 1 {
+		panic("Invalid arguments")
+	}
+	bindings := letBindings(args[0])
+	values := make([]parser.Value, len(bindings))
+	for i, b := range bindings {
+		values[i] = ctx.MustEval(b.expr)
+	}
+	nested := NewContext(ctx)
+	for i, b := range bindings {
+		Bind(nested, b.pattern, values[i])
+	}
+	return tailBody(nested, args[1:])
+}
+
+// LetStar implements the 'let*' special form. It is similar to the scoped
+// let but each expression is evaluated with the previous names bound.
+func LetStar(ctx *Context, args ...parser.Value) parser.Value {
+	if len(args) < 1 {
+		panic("Invalid arguments")
+	}
+	nested := NewContext(ctx)
+	for _, b := range letBindings(args[0]) {
+		value := nested.MustEval(b.expr)
+		nested = NewContext(nested)
+		Bind(nested, b.pattern, value)
+	}
+	return tailBody(nested, args[1:])
+}
+
+// LetRec implements the 'letrec' special form. It is similar to the scoped
+// let but expressions are evaluated in the new context, so functions can refer
+// to themselves and to each other.
+func LetRec(ctx *Context, args ...parser.Value) parser.Value {
+	if len(args) < 1 {
+		panic("Invalid arguments")
+	}
+	nested := NewContext(ctx)
+	for _, b := range letBindings(args[0]) {
+		Bind(nested, b.pattern, nested.MustEval(b.expr))
+	}
+	return tailBody(nested, args[1:])
+}
+
+// recurCall is the value of a recur expression: the new values for the
+// bindings of the enclosing loop or function.
+type recurCall struct {
+	args []parser.Value
+}
+
+// recurMsg is the message of the ErrRecur errors.
+const recurMsg = "recur must be in tail position"
+
+// isRecur reports whether v is the value of a recur expression.
+func isRecur(v parser.Value) bool {
+	_, ok := v.Value().(*recurCall)
+	return ok
+}
+
+// notRecur returns v, or raises an ErrRecur error if it is the value of a
+// recur expression, which is not in tail position of a loop or function.
+func notRecur(v parser.Value) parser.Value {
+	if isRecur(v) {
+		panic(&Error{Code: ErrRecur, Msg: recurMsg})
+	}
+	return v
+}
+
+// Recur implements the 'recur' special form: (recur value...). It must be in
+// tail position of a loop or function body, which is then evaluated again with
+// the new values bound.
+func Recur(ctx *Context, args ...parser.Value) parser.Value {
+	values := make([]parser.Value, len(args))
+	for i, arg := range args {
+		values[i] = ctx.MustEval(arg)
+	}
+	return parser.NewAny(&recurCall{args: values}, nil)
+}
+
+// Loop implements the 'loop' special form:
+//
+//	(loop ((pattern init)...) body...)
+//
+// It is similar to the scoped let, but the body can use recur to be evaluated
+// again with new values for the bindings, without growing the stack.
+func Loop(ctx *Context, args ...parser.Value) parser.Value {
+	if len(args) < 1 {
+		panic("Invalid arguments")
+	}
+	bindings := letBindings(args[0])
+	values := make([]parser.Value, len(bindings))
+	for i, b := range bindings {
+		values[i] = ctx.MustEval(b.expr)
+	}
+	for {
+		nested := NewContext(ctx)
+		for i, b := range bindings {
+			Bind(nested, b.pattern, values[i])
+		}
+		result := recurBody(nested, args[1:])
+		nested.release()
+		r, ok := result.Value().(*recurCall)
+		if !ok {
+			return result
+		}
+		if len(r.args) != len(bindings) {
+			panic(&Error{
+				Code: ErrArity,
+				Msg:  fmt.Sprintf("recur expects %d arguments, got %d", len(bindings), len(r.args)),
+			})
+		}
+		values = r.args
+	}
+}
@@ -0,0 +1,240 @@
+package runtime
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/rumlang/rum/parser"
+)
+
+// Destructuring patterns are accepted in every binding position (let forms,
+// lambda and def parameters, for loops):
+//
+//	name                     binds the whole value
+//	_                        matches anything, binds nothing
+//	(a b & rest :as all)     positional pattern on lists and Go slices
+//	(:keys a (b "k") :or ((a 1)) :as m)
+//	                         map pattern on Go maps
+//
+// Elements of positional patterns and (pattern key) entries of map patterns
+// are patterns themselves, so they can be nested.
+
+// bindError describes why a value did not match a pattern.
+type bindError struct {
+	pattern parser.Value
+	msg     string
+}
+
+func (e *bindError) Error() string {
+	return fmt.Sprintf("%s: %s", e.pattern, e.msg)
+}
+
+// Bind matches value against pattern and defines all the names of the
+// pattern in ctx. It panics with an *Error (code ErrBinding) describing which
+// element failed to match.
+func Bind(ctx *Context, pattern parser.Value, value parser.Value) {
+	if err := bind(ctx, pattern, value); err != nil {
+		panic(&Error{
+			Code: ErrBinding,
+			Msg:  err.Error(),
+		})
+	}
+}
+
+func bind(ctx *Context, pattern parser.Value, value parser.Value) error {
+	switch p := pattern.Value().(type) {
+	case parser.Identifier:
+		if p != "_" {
+			sym, _ := parser.SymbolOf(pattern)
+			ctx.define(sym, value, true)
+		}
+		return nil
+	case []parser.Value:
+		if len(p) > 0 && isMarker(p[0], ":keys") {
+			return bindMap(ctx, pattern, p[1:], value)
+		}
+		return bindSequence(ctx, pattern, p, value)
+	default:
+		return &bindError{pattern, fmt.Sprintf("invalid pattern of type %T", p)}
+	}
+}
+
+// isMarker reports whether v is the given marker identifier.
+func isMarker(v parser.Value, marker parser.Identifier) bool {
+	id, ok := v.Value().(parser.Identifier)
+	return ok && id == marker
+}
+
+// markerArg returns the argument following the marker at index i in the
+// pattern elements.
+func markerArg(pattern parser.Value, elts []parser.Value, i int) (parser.Value, error) {
+	if i+1 >= len(elts) {
+		return nil, &bindError{pattern, fmt.Sprintf("missing pattern after %s", elts[i])}
+	}
+	return elts[i+1], nil
+}
+
+// toList returns the elements of v if it is a Rum list or a Go slice or array.
+func toList(v interface{}) ([]parser.Value, bool) {
+	if list, ok := v.([]parser.Value); ok {
+		return list, true
+	}
+	if v == nil {
+		return nil, false
+	}
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array {
+		return nil, false
+	}
+	list := make([]parser.Value, rv.Len())
+	for i := range list {
+		list[i] = parser.NewAny(rv.Index(i).Interface(), nil)
+	}
+	return list, true
+}
+
+// bindSequence matches a positional pattern: (a b & rest :as all).
+func bindSequence(ctx *Context, pattern parser.Value, elts []parser.Value, value parser.Value) error {
+	values, ok := toList(value.Value())
+	if !ok {
+		return &bindError{pattern, fmt.Sprintf("expected a list, got %T", value.Value())}
+	}
+
+	var positional []parser.Value
+	var rest, as parser.Value
+	for i := 0; i < len(elts); i++ {
+		var err error
+		switch {
+		case isMarker(elts[i], "&"):
+			rest, err = markerArg(pattern, elts, i)
+			i++
+		case isMarker(elts[i], ":as"):
+			as, err = markerArg(pattern, elts, i)
+			i++
+		default:
+			positional = append(positional, elts[i])
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(values) < len(positional) {
+		return &bindError{pattern, fmt.Sprintf("element %d (%s) has no value - got only %d elements", len(values), positional[len(values)], len(values))}
+	}
+	if rest == nil && len(values) > len(positional) {
+		return &bindError{pattern, fmt.Sprintf("expected %d elements, got %d", len(positional), len(values))}
+	}
+
+	for i, p := range positional {
+		if err := bind(ctx, p, values[i]); err != nil {
+			return &bindError{pattern, fmt.Sprintf("element %d: %s", i, err)}
+		}
+	}
+	if rest != nil {
+		tail := parser.NewAny(values[len(positional):], value.Ref())
+		if err := bind(ctx, rest, tail); err != nil {
+			return &bindError{pattern, fmt.Sprintf("rest: %s", err)}
+		}
+	}
+	if as != nil {
+		return bind(ctx, as, value)
+	}
+	return nil
+}
+
+// mapLookup returns the entry of the Go map m with the provided key name. The
+// key can either be a string or an identifier.
+func mapLookup(m reflect.Value, name string) (parser.Value, bool) {
+	for _, key := range []interface{}{name, parser.Identifier(name)} {
+		k := reflect.ValueOf(key)
+		if !k.Type().AssignableTo(m.Type().Key()) {
+			if !k.Type().ConvertibleTo(m.Type().Key()) {
+				continue
+			}
+			k = k.Convert(m.Type().Key())
+		}
+		if v := m.MapIndex(k); v.IsValid() {
+			return parser.NewAny(v.Interface(), nil), true
+		}
+	}
+	return nil, false
+}
+
+// bindMap matches a map pattern: (:keys a (b "key") :or ((a 1)) :as m).
+func bindMap(ctx *Context, pattern parser.Value, elts []parser.Value, value parser.Value) error {
+	m := reflect.ValueOf(value.Value())
+	if r, ok := value.Value().(*Record); ok {
+		m = reflect.ValueOf(r.Map())
+	}
+	if m.Kind() != reflect.Map {
+		return &bindError{pattern, fmt.Sprintf("expected a map, got %T", value.Value())}
+	}
+
+	type entry struct {
+		pattern parser.Value
+		key     string
+	}
+	var entries []entry
+	defaults := map[parser.Identifier]parser.Value{}
+	var as parser.Value
+	for i := 0; i < len(elts); i++ {
+		switch {
+		case isMarker(elts[i], ":or"):
+			arg, err := markerArg(pattern, elts, i)
+			if err != nil {
+				return err
+			}
+			i++
+			for _, b := range letBindings(arg) {
+				id, ok := b.pattern.Value().(parser.Identifier)
+				if !ok {
+					return &bindError{pattern, fmt.Sprintf("invalid default for %s", b.pattern)}
+				}
+				defaults[id] = b.expr
+			}
+		case isMarker(elts[i], ":as"):
+			arg, err := markerArg(pattern, elts, i)
+			if err != nil {
+				return err
+			}
+			i++
+			as = arg
+		default:
+			switch e := elts[i].Value().(type) {
+			case parser.Identifier:
+				entries = append(entries, entry{elts[i], string(e)})
+			case []parser.Value:
+				if len(e) != 2 {
+					return &bindError{pattern, fmt.Sprintf("invalid entry %s - expected (pattern key)", elts[i])}
+				}
+				key, ok := e[1].Value().(string)
+				if !ok {
+					key = e[1].String()
+				}
+				entries = append(entries, entry{e[0], key})
+			default:
+				return &bindError{pattern, fmt.Sprintf("invalid entry %s", elts[i])}
+			}
+		}
+	}
+
+	for _, e := range entries {
+		v, ok := mapLookup(m, e.key)
+		if !ok {
+			id, _ := e.pattern.Value().(parser.Identifier)
+			expr, hasDefault := defaults[id]
+			if !hasDefault {
+				return &bindError{pattern, fmt.Sprintf("key %q is missing", e.key)}
+			}
+			v = ctx.MustEval(expr)
+		}
+		if err := bind(ctx, e.pattern, v); err != nil {
+			return &bindError{pattern, fmt.Sprintf("key %q: %s", e.key, err)}
+		}
+	}
+	if as != nil {
+		return bind(ctx, as, value)
+	}
+	return nil
+}
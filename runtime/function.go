@@ -0,0 +1,358 @@
+package runtime
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/rumlang/rum/parser"
+)
+
+// IsKeyword reports whether id is a keyword - an identifier starting with ':'.
+// Keywords evaluate to themselves.
+func IsKeyword(id parser.Identifier) bool {
+	return strings.HasPrefix(string(id), ":")
+}
+
+// param is an optional or keyword parameter, with its default expression.
+type param struct {
+	pattern parser.Value
+	// key is the keyword used to pass a keyword parameter, e.g. ":name".
+	key parser.Identifier
+	// init is evaluated when no value is provided; nil means nil.
+	init parser.Value
+}
+
+// arity is one implementation of a function, selected according to the
+// number of positional arguments:
+//
+//	(required... &optional opt (opt default)... &key key (key default)... & rest :as all)
+type arity struct {
+	params   parser.Value
+	required []parser.Value
+	optional []param
+	keys     []param
+	rest     parser.Value
+	as       parser.Value
+	body     []parser.Value
+	// recur is true when the body uses recur to call this function again.
+	recur bool
+}
+
+// accepts reports whether this arity can be called with n positional
+// arguments.
+func (a *arity) accepts(n int) bool {
+	if n < len(a.required) {
+		return false
+	}
+	return a.rest != nil || n <= len(a.required)+len(a.optional)
+}
+
+// expected describes the number of positional arguments accepted.
+func (a *arity) expected() string {
+	min := len(a.required)
+	switch {
+	case a.rest != nil:
+		return fmt.Sprintf("at least %d", min)
+	case len(a.optional) > 0:
+		return fmt.Sprintf("%d to %d", min, min+len(a.optional))
+	default:
+		return fmt.Sprintf("%d", min)
+	}
+}
+
+// Function is a function defined in Rum code, either with def or lambda. It
+// has one or more arities and keeps a reference to the context where it was
+// defined.
+type Function struct {
+	// Name of the function; empty for lambdas.
+	Name    string
+	ctx     *Context
+	arities []*arity
+}
+
+func (f *Function) String() string {
+	if f.Name == "" {
+		return "<lambda>"
+	}
+	return fmt.Sprintf("<function %s>", f.Name)
+}
+
+// NewFunction creates a function from the arguments of def (without the name)
+// or lambda. It either takes a parameter list followed by the body or, for
+// multiple arities, a list of ((params...) body...) definitions.
+func NewFunction(ctx *Context, name string, args []parser.Value) *Function {
+	f := &Function{Name: name, ctx: ctx}
+
+	defs := [][]parser.Value{args}
+	if isMultiArity(args) {
+		defs = nil
+		for _, arg := range args {
+			defs = append(defs, arg.Value().([]parser.Value))
+		}
+	}
+
+	for _, def := range defs {
+		a := parseParams(def[0])
+		a.body = def[1:]
+		a.recur = usesRecur(a.body)
+		f.arities = append(f.arities, a)
+	}
+	return f
+}
+
+// isMultiArity reports whether args are the definitions of several arities:
+// at least two ((params...) body...) clauses, and nothing else. A clause has
+// a body, which tells it apart from a single parameter list destructuring its
+// first argument, like ((a b)) in (lambda ((a b)) ((f) a)).
+func isMultiArity(args []parser.Value) bool {
+	if len(args) < 2 {
+		return false
+	}
+	for _, arg := range args {
+		def, ok := arg.Value().([]parser.Value)
+		if !ok || len(def) < 2 || !isParamList(def[0]) {
+			return false
+		}
+	}
+	return true
+}
+
+// isParamList reports whether v can be a parameter list: a list of names and
+// patterns.
+func isParamList(v parser.Value) bool {
+	elts, ok := v.Value().([]parser.Value)
+	if !ok {
+		return false
+	}
+	for _, elt := range elts {
+		switch elt.Value().(type) {
+		case parser.Identifier, []parser.Value:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// usesRecur reports whether recur is used in body - ignoring the nested loops
+// and lambdas, which recur targets instead.
+func usesRecur(body []parser.Value) bool {
+	for _, v := range body {
+		switch data := v.Value().(type) {
+		case parser.Identifier:
+			if data == "recur" {
+				return true
+			}
+		case []parser.Value:
+			if len(data) > 0 && (isMarker(data[0], "loop") || isMarker(data[0], "lambda")) {
+				continue
+			}
+			if usesRecur(data) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// parseParams parses a parameter list.
+func parseParams(params parser.Value) *arity {
+	elts, ok := params.Value().([]parser.Value)
+	if !ok {
+		panic(fmt.Sprintf("Invalid parameter list: %s", params))
+	}
+
+	a := &arity{params: params}
+	section := parser.Identifier("")
+	for i := 0; i < len(elts); i++ {
+		if id, ok := elts[i].Value().(parser.Identifier); ok {
+			switch id {
+			case "&optional", "&key":
+				section = id
+				continue
+			case "&", ":as":
+				if i+1 >= len(elts) {
+					panic(fmt.Sprintf("Missing parameter after %s in %s", id, params))
+				}
+				i++
+				if id == "&" {
+					a.rest = elts[i]
+				} else {
+					a.as = elts[i]
+				}
+				continue
+			}
+		}
+
+		switch section {
+		case "&optional":
+			a.optional = append(a.optional, parseParam(elts[i]))
+		case "&key":
+			p := parseParam(elts[i])
+			id, ok := p.pattern.Value().(parser.Identifier)
+			if !ok {
+				panic(fmt.Sprintf("Invalid keyword parameter: %s", elts[i]))
+			}
+			p.key = ":" + id
+			a.keys = append(a.keys, p)
+		default:
+			a.required = append(a.required, elts[i])
+		}
+	}
+	return a
+}
+
+// parseParam parses an optional or keyword parameter: either a single pattern
+// or a (pattern default) pair.
+func parseParam(v parser.Value) param {
+	if pair, ok := v.Value().([]parser.Value); ok {
+		if len(pair) != 2 {
+			panic(fmt.Sprintf("Invalid parameter %s - expected (name default)", v))
+		}
+		return param{pattern: pair[0], init: pair[1]}
+	}
+	return param{pattern: v}
+}
+
+// name returns the name of the function used in error messages.
+func (f *Function) name() string {
+	if f.Name == "" {
+		return "lambda"
+	}
+	return f.Name
+}
+
+// arityError generates the error sent when no arity matches a call.
+func (f *Function) arityError(n int, ref *parser.SourceRef) *Error {
+	var expected []string
+	for _, a := range f.arities {
+		expected = append(expected, a.expected())
+	}
+	msg := fmt.Sprintf("%s expects %s arguments, got %d", f.name(), strings.Join(expected, " or "), n)
+	if ref != nil {
+		msg += fmt.Sprintf(" (called at line %d, col %d)", ref.Line+1, ref.Column+1)
+	}
+	return &Error{
+		Code: ErrArity,
+		Msg:  msg,
+	}
+}
+
+// Apply calls the function with the provided evaluated arguments.
+func (f *Function) Apply(args ...parser.Value) parser.Value {
+	return resolve(f.call(args, nil))
+}
+
+// call evaluates the body of the arity matching the arguments, in a new
+// child of the definition context. ref is the call site. The last expression
+// of the body is returned as a tail call, unless the body uses recur.
+func (f *Function) call(args []parser.Value, ref *parser.SourceRef) parser.Value {
+	for {
+		nested, a := f.bindArgs(args, ref)
+		if !a.recur {
+			return tailBody(nested, a.body)
+		}
+		result := recurBody(nested, a.body)
+		nested.release()
+		r, ok := result.Value().(*recurCall)
+		if !ok {
+			return result
+		}
+		args = r.args
+	}
+}
+
+// bindArgs selects the arity matching the evaluated arguments and binds them
+// in a new child of the definition context.
+func (f *Function) bindArgs(args []parser.Value, ref *parser.SourceRef) (*Context, *arity) {
+	// Keyword arguments can only be used with single arity functions.
+	var keys []param
+	if len(f.arities) == 1 {
+		keys = f.arities[0].keys
+	}
+	positional, named := splitKeywordArgs(args, keys)
+
+	var a *arity
+	for _, candidate := range f.arities {
+		if candidate.accepts(len(positional)) {
+			a = candidate
+			break
+		}
+	}
+	if a == nil {
+		panic(f.arityError(len(positional), ref))
+	}
+
+	nested := NewContext(f.ctx)
+	for i, p := range a.required {
+		bindParam(nested, a.params, p, positional[i])
+	}
+	positional = positional[len(a.required):]
+	for _, p := range a.optional {
+		var v parser.Value
+		if len(positional) > 0 {
+			v, positional = positional[0], positional[1:]
+		} else {
+			v = evalInit(nested, p.init)
+		}
+		bindParam(nested, a.params, p.pattern, v)
+	}
+	for _, p := range a.keys {
+		v, ok := named[p.key]
+		if !ok {
+			v = evalInit(nested, p.init)
+		}
+		bindParam(nested, a.params, p.pattern, v)
+	}
+	if a.rest != nil {
+		bindParam(nested, a.params, a.rest, parser.NewAny(positional, nil))
+	}
+	if a.as != nil {
+		bindParam(nested, a.params, a.as, parser.NewAny(args, nil))
+	}
+	return nested, a
+}
+
+// splitKeywordArgs separates the keyword arguments (:key value) matching one
+// of the keys from the positional ones.
+func splitKeywordArgs(args []parser.Value, keys []param) ([]parser.Value, map[parser.Identifier]parser.Value) {
+	if len(keys) == 0 {
+		return args, nil
+	}
+	declared := map[parser.Identifier]bool{}
+	for _, k := range keys {
+		declared[k.key] = true
+	}
+
+	var positional []parser.Value
+	named := map[parser.Identifier]parser.Value{}
+	for i := 0; i < len(args); i++ {
+		id, ok := args[i].Value().(parser.Identifier)
+		if ok && declared[id] && i+1 < len(args) {
+			named[id] = args[i+1]
+			i++
+			continue
+		}
+		positional = append(positional, args[i])
+	}
+	return positional, named
+}
+
+// evalInit evaluates the default expression of a parameter.
+func evalInit(ctx *Context, init parser.Value) parser.Value {
+	if init == nil {
+		return parser.NewAny(nil, nil)
+	}
+	return ctx.MustEval(init)
+}
+
+// bindParam binds a single parameter, reporting errors relative to the full
+// parameter list.
+func bindParam(ctx *Context, params parser.Value, pattern parser.Value, v parser.Value) {
+	if err := bind(ctx, pattern, v); err != nil {
+		panic(&Error{
+			Code: ErrBinding,
+			Msg:  fmt.Sprintf("%s: %s", params, err),
+		})
+	}
+}
@@ -1,6 +1,8 @@
 package runtime
 
 import (
+	"fmt"
+	"reflect"
 	"strings"
 
 	"github.com/rumlang/rum/parser"
@@ -19,3 +21,62 @@ func MethodNameTransform(name string) (newName string) {
 	}
 	return
 }
+
+// Equal reports whether a and b hold the same value. Integers and floats are
+// compared numerically and records field by field; anything else must be
+// deeply equal.
+func Equal(a, b interface{}) bool {
+	switch x := a.(type) {
+	case int64:
+		if y, ok := b.(float64); ok {
+			return float64(x) == y
+		}
+	case float64:
+		if y, ok := b.(int64); ok {
+			return x == float64(y)
+		}
+	case *Record:
+		if y, ok := b.(*Record); ok {
+			return x.Equal(y)
+		}
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// Compare returns -1, 0 or 1 depending on whether a is lower, equal or greater
+// than b. Numbers and strings are compared by value; other values are compared
+// by their representation.
+func Compare(a, b interface{}) int {
+	switch x := a.(type) {
+	case int64:
+		switch y := b.(type) {
+		case int64:
+			return compareOrdered(x < y, x > y)
+		case float64:
+			return compareOrdered(float64(x) < y, float64(x) > y)
+		}
+	case float64:
+		switch y := b.(type) {
+		case int64:
+			return compareOrdered(x < float64(y), x > float64(y))
+		case float64:
+			return compareOrdered(x < y, x > y)
+		}
+	case string:
+		if y, ok := b.(string); ok {
+			return strings.Compare(x, y)
+		}
+	}
+	return strings.Compare(fmt.Sprint(a), fmt.Sprint(b))
+}
+
+func compareOrdered(less, greater bool) int {
+	switch {
+	case less:
+		return -1
+	case greater:
+		return 1
+	default:
+		return 0
+	}
+}
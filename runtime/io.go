@@ -0,0 +1,111 @@
+package runtime
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/rumlang/rum/parser"
+)
+
+// SetStdout sets the writer of the printing builtins evaluated in the context
+// and its children, also bound to *out*.
+func (c *Context) SetStdout(w io.Writer) {
+	c.stdout = w
+	c.bindIO()
+}
+
+// SetStderr sets the writer of the warnings of the context and its children,
+// also bound to *err*.
+func (c *Context) SetStderr(w io.Writer) {
+	c.stderr = w
+	c.bindIO()
+}
+
+// SetStdin sets the reader of the context and its children, bound to *in*.
+func (c *Context) SetStdin(r io.Reader) {
+	c.stdin = r
+	c.bindIO()
+}
+
+// Stdout returns the writer of the context, inherited from its parents. It
+// is os.Stdout by default.
+func (c *Context) Stdout() io.Writer {
+	for ; c != nil; c = c.parent {
+		if c.stdout != nil {
+			return c.stdout
+		}
+	}
+	return os.Stdout
+}
+
+// Stderr returns the error writer of the context, inherited from its
+// parents. It is os.Stderr by default.
+func (c *Context) Stderr() io.Writer {
+	for ; c != nil; c = c.parent {
+		if c.stderr != nil {
+			return c.stderr
+		}
+	}
+	return os.Stderr
+}
+
+// Stdin returns the reader of the context, inherited from its parents. It is
+// os.Stdin by default.
+func (c *Context) Stdin() io.Reader {
+	for ; c != nil; c = c.parent {
+		if c.stdin != nil {
+			return c.stdin
+		}
+	}
+	return os.Stdin
+}
+
+// ioBindings are the names bound by bindIO.
+var ioBindings = []parser.Identifier{"print", "println", "pr", "prn", "*out*", "*err*", "*in*"}
+
+// bindIO defines the printing builtins in the context, writing to its
+// streams: print and println display values, pr and prn print them as Rum
+// source. The streams are also bound to *out*, *err* and *in*. Without
+// CapStdout, the printing builtins raise capability errors instead.
+func (c *Context) bindIO() {
+	if !c.HasCapability(CapStdout) {
+		for _, id := range ioBindings {
+			delete(c.env, id.Symbol())
+		}
+		for _, id := range ioBindings[:4] {
+			c.env[id.Symbol()] = parser.NewAny(denied(string(id), CapStdout), nil)
+		}
+		return
+	}
+
+	bindings := map[parser.Identifier]interface{}{
+		"print": func(args ...interface{}) {
+			fprint(c.Stdout(), args...)
+		},
+		"println": func(args ...interface{}) {
+			fprint(c.Stdout(), args...)
+			fmt.Fprintln(c.Stdout())
+		},
+		"pr": func(args ...interface{}) {
+			fpr(c.Stdout(), args...)
+		},
+		"prn": func(args ...interface{}) {
+			fpr(c.Stdout(), args...)
+			fmt.Fprintln(c.Stdout())
+		},
+		"*out*": c.Stdout(),
+		"*err*": c.Stderr(),
+		"*in*":  c.Stdin(),
+	}
+	for id, v := range bindings {
+		c.env[id.Symbol()] = parser.NewAny(v, nil)
+	}
+}
+
+// Fprintf implements the fprintf function: (fprintf writer format args...).
+func Fprintf(w io.Writer, format string, args ...interface{}) {
+	if _, err := fmt.Fprintf(w, format, args...); err != nil {
+		panic(err)
+	}
+}
@@ -0,0 +1,274 @@
+package runtime
+
+import (
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+
+	"github.com/rumlang/rum/parser"
+)
+
+// Iterator provides the elements of a collection one at a time.
+type Iterator interface {
+	// Next returns the next element, or false once all the elements have been
+	// returned. Errors are sent through panics.
+	Next() (parser.Value, bool)
+}
+
+// Iterable is implemented by the types which can be iterated by the for
+// forms and the sequence functions.
+type Iterable interface {
+	Iterator() Iterator
+}
+
+// Iterate returns an iterator on the elements of v. Supported values are:
+// Iterable and Iterator values, Rum lists, Go slices, arrays, maps (elements
+// are (key value) entries, ordered by key), channels (until closed), strings
+// (one string per rune), *csv.Reader (one record at a time) and
+// *bufio.Scanner (one token at a time). nil is an empty collection.
+func Iterate(v interface{}) (Iterator, bool) {
+	switch data := v.(type) {
+	case nil:
+		return &listIterator{}, true
+	case Iterator:
+		return data, true
+	case Iterable:
+		return data.Iterator(), true
+	case []parser.Value:
+		return &listIterator{list: data}, true
+	case string:
+		return &stringIterator{runes: []rune(data)}, true
+	case *csv.Reader:
+		return &csvIterator{reader: data}, true
+	case *bufio.Scanner:
+		return &scannerIterator{scanner: data}, true
+	}
+
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Slice, reflect.Array:
+		return &sliceIterator{slice: rv}, true
+	case reflect.Map:
+		return &mapIterator{m: rv, keys: sortedKeys(rv)}, true
+	case reflect.Chan:
+		return &chanIterator{ch: rv}, true
+	}
+	return nil, false
+}
+
+// MustIterate is similar to Iterate but panics when v can not be iterated.
+func MustIterate(v interface{}) Iterator {
+	it, ok := Iterate(v)
+	if !ok {
+		panic(fmt.Sprintf("Unable to iterate over values of type %T", v))
+	}
+	return it
+}
+
+// IsMap reports whether v is a Go map - which are iterated as (key value)
+// entries.
+func IsMap(v interface{}) bool {
+	return v != nil && reflect.TypeOf(v).Kind() == reflect.Map
+}
+
+type listIterator struct {
+	list []parser.Value
+}
+
+func (it *listIterator) Next() (parser.Value, bool) {
+	if len(it.list) == 0 {
+		return nil, false
+	}
+	v := it.list[0]
+	it.list = it.list[1:]
+	return v, true
+}
+
+type stringIterator struct {
+	runes []rune
+}
+
+func (it *stringIterator) Next() (parser.Value, bool) {
+	if len(it.runes) == 0 {
+		return nil, false
+	}
+	v := string(it.runes[0])
+	it.runes = it.runes[1:]
+	return parser.NewAny(v, nil), true
+}
+
+type sliceIterator struct {
+	slice reflect.Value
+	i     int
+}
+
+func (it *sliceIterator) Next() (parser.Value, bool) {
+	if it.i >= it.slice.Len() {
+		return nil, false
+	}
+	v := it.slice.Index(it.i).Interface()
+	it.i++
+	return parser.NewAny(v, nil), true
+}
+
+type mapIterator struct {
+	m    reflect.Value
+	keys []reflect.Value
+}
+
+func (it *mapIterator) Next() (parser.Value, bool) {
+	if len(it.keys) == 0 {
+		return nil, false
+	}
+	k := it.keys[0]
+	it.keys = it.keys[1:]
+	entry := []parser.Value{
+		parser.NewAny(k.Interface(), nil),
+		parser.NewAny(it.m.MapIndex(k).Interface(), nil),
+	}
+	return parser.NewAny(entry, nil), true
+}
+
+// sortedKeys returns the keys of the map m, in a deterministic order.
+func sortedKeys(m reflect.Value) []reflect.Value {
+	keys := m.MapKeys()
+	sort.Slice(keys, func(i, j int) bool {
+		return Compare(keys[i].Interface(), keys[j].Interface()) < 0
+	})
+	return keys
+}
+
+type chanIterator struct {
+	ch reflect.Value
+	// ev is the evaluation which stops the iteration when it is done.
+	ev *evaluation
+}
+
+func (it *chanIterator) Next() (parser.Value, bool) {
+	if it.ev == nil || it.ev.done == nil {
+		v, ok := it.ch.Recv()
+		if !ok {
+			return nil, false
+		}
+		return parser.NewAny(v.Interface(), nil), true
+	}
+
+	chosen, v, ok := reflect.Select([]reflect.SelectCase{
+		{Dir: reflect.SelectRecv, Chan: it.ch},
+		{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(it.ev.done)},
+	})
+	if chosen == 1 {
+		panic(it.ev.stopped())
+	}
+	if !ok {
+		return nil, false
+	}
+	return parser.NewAny(v.Interface(), nil), true
+}
+
+type csvIterator struct {
+	reader *csv.Reader
+}
+
+func (it *csvIterator) Next() (parser.Value, bool) {
+	record, err := it.reader.Read()
+	if err == io.EOF {
+		return nil, false
+	}
+	if err != nil {
+		panic(err)
+	}
+	return parser.NewAny(record, nil), true
+}
+
+type scannerIterator struct {
+	scanner *bufio.Scanner
+}
+
+func (it *scannerIterator) Next() (parser.Value, bool) {
+	if !it.scanner.Scan() {
+		if err := it.scanner.Err(); err != nil {
+			panic(err)
+		}
+		return nil, false
+	}
+	return parser.NewAny(it.scanner.Text(), nil), true
+}
+
+// forBindings parses the binding list of the for forms: (pattern coll) or
+// (index pattern coll). It returns nil as index pattern for the first form.
+func forBindings(v parser.Value) (index, pattern, coll parser.Value) {
+	elts, ok := v.Value().([]parser.Value)
+	if !ok || len(elts) < 2 || len(elts) > 3 {
+		panic(fmt.Sprintf("Invalid for bindings %s - expected (name coll) or (index name coll)", v))
+	}
+	if len(elts) == 2 {
+		return nil, elts[0], elts[1]
+	}
+	return elts[0], elts[1], elts[2]
+}
+
+// iterate implements the for forms: it evaluates the body for each element of
+// the collection and calls fn with the result.
+func iterate(ctx *Context, args []parser.Value, fn func(parser.Value)) {
+	if len(args) < 1 {
+		panic("Invalid arguments")
+	}
+	index, pattern, collExpr := forBindings(args[0])
+	coll := ctx.MustEval(collExpr).Value()
+	isMap := IsMap(coll)
+	it := MustIterate(coll)
+	if ch, ok := it.(*chanIterator); ok {
+		ch.ev = ctx.root().current()
+	}
+
+	for i := int64(0); ; i++ {
+		v, ok := it.Next()
+		if !ok {
+			return
+		}
+		nested := NewContext(ctx)
+		switch {
+		case index == nil:
+			Bind(nested, pattern, v)
+		case isMap:
+			entry := v.Value().([]parser.Value)
+			Bind(nested, index, entry[0])
+			Bind(nested, pattern, entry[1])
+		default:
+			Bind(nested, index, parser.NewAny(i, nil))
+			Bind(nested, pattern, v)
+		}
+		v = evalBody(nested, args[1:])
+		nested.release()
+		fn(v)
+	}
+}
+
+// For implements the 'for' special form, which builds a list with the value
+// of the body for each element of a collection:
+//
+//	(for (pattern coll) body...)
+//	(for (index pattern coll) body...)
+//
+// The second form also binds the index of each element - or its key when
+// iterating over a map. Any value supported by Iterate can be used.
+func For(ctx *Context, args ...parser.Value) parser.Value {
+	result := []parser.Value{}
+	ev := ctx.root().current()
+	iterate(ctx, args, func(v parser.Value) {
+		ev.alloc(valueSize)
+		result = append(result, v)
+	})
+	return parser.NewAny(result, nil)
+}
+
+// ForEach implements the 'for-each' (or 'doseq') special form. It is similar
+// to for, but it is only used for side effects and returns nil.
+func ForEach(ctx *Context, args ...parser.Value) parser.Value {
+	iterate(ctx, args, func(parser.Value) {})
+	return parser.NewAny(nil, nil)
+}
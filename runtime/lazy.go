@@ -0,0 +1,318 @@
+package runtime
+
+import (
+	"bytes"
+	"runtime"
+	"strconv"
+	"sync"
+
+	"github.com/rumlang/rum/parser"
+)
+
+// LazySeq is a sequence whose elements are computed on demand. Each node of
+// the sequence is realized at most once and caches its element, so a lazy
+// sequence can be iterated several times. As nodes are linked, the elements
+// which are not referenced anymore can be garbage collected: iterating over a
+// huge input does not keep it in memory.
+//
+// A node can not be realized by its own body, as in
+// (let s (lazy-seq (first s))): this raises an *Error with the code
+// ErrLazySeq. The other goroutines realizing a node wait for it instead.
+type LazySeq struct {
+	mu sync.Mutex
+	// thunk computes the node; it returns nil for an empty sequence.
+	thunk func() *LazySeq
+	// realizing is the goroutine running the thunk, if any, and waiting is
+	// closed when it returns.
+	realizing int64
+	waiting   chan struct{}
+	realized  bool
+	empty     bool
+	first     parser.Value
+	rest      *LazySeq
+}
+
+// IteratorFunc adapts a function to the Iterator interface.
+type IteratorFunc func() (parser.Value, bool)
+
+// Next implements the Iterator interface.
+func (f IteratorFunc) Next() (parser.Value, bool) {
+	return f()
+}
+
+// NewLazySeq creates a lazy sequence reading its elements from it, only when
+// they are needed. It can be used to adapt any Go iterator.
+func NewLazySeq(it Iterator) *LazySeq {
+	return lazySeq(func() *LazySeq {
+		v, ok := it.Next()
+		if !ok {
+			return nil
+		}
+		return consSeq(v, NewLazySeq(it))
+	})
+}
+
+// lazySeq creates a lazy sequence computed by thunk.
+func lazySeq(thunk func() *LazySeq) *LazySeq {
+	return &LazySeq{thunk: thunk}
+}
+
+// consSeq creates a realized node of a lazy sequence.
+func consSeq(first parser.Value, rest *LazySeq) *LazySeq {
+	return &LazySeq{realized: true, first: first, rest: rest}
+}
+
+// emptySeq returns an empty lazy sequence.
+func emptySeq() *LazySeq {
+	return &LazySeq{realized: true, empty: true}
+}
+
+// toSeq returns coll as a lazy sequence.
+func toSeq(coll interface{}) *LazySeq {
+	if s, ok := coll.(*LazySeq); ok {
+		return s
+	}
+	return NewLazySeq(MustIterate(coll))
+}
+
+// realize computes the node if it was not done yet. id is the running
+// goroutine, 0 if it was not computed yet.
+func (s *LazySeq) realize(id int64) int64 {
+	s.mu.Lock()
+	if s.realized {
+		s.mu.Unlock()
+		return id
+	}
+	if id == 0 {
+		id = goroutineID()
+	}
+	for s.realizing != 0 && s.realizing != id {
+		// Another goroutine is realizing the node: wait for it, and realize
+		// it again if it failed.
+		waiting := s.waiting
+		s.mu.Unlock()
+		<-waiting
+		s.mu.Lock()
+	}
+	if s.realized {
+		s.mu.Unlock()
+		return id
+	}
+	if s.realizing == id {
+		s.mu.Unlock()
+		panic(&Error{Code: ErrLazySeq, Msg: "lazy sequence realized while it is being realized"})
+	}
+	// The lock is not held while the thunk runs, for a thunk referring to its
+	// own node to raise an error instead of blocking forever.
+	s.realizing, s.waiting = id, make(chan struct{})
+	thunk := s.thunk
+	s.mu.Unlock()
+
+	var node *LazySeq
+	done := false
+	defer func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.realizing = 0
+		close(s.waiting)
+		if !done {
+			return
+		}
+		if node == nil {
+			s.empty = true
+		} else {
+			s.empty, s.first, s.rest = node.empty, node.first, node.rest
+		}
+		s.thunk = nil
+		s.realized = true
+	}()
+	node = thunk()
+	if node != nil {
+		node.realize(id)
+	}
+	done = true
+	return id
+}
+
+// goroutineID returns the id of the running goroutine, read from the header of
+// its stack: "goroutine <id> [...".
+func goroutineID() int64 {
+	var buf [64]byte
+	header := bytes.Fields(buf[:runtime.Stack(buf[:], false)])
+	id, _ := strconv.ParseInt(string(header[1]), 10, 64)
+	return id
+}
+
+// Iterator implements the Iterable interface.
+func (s *LazySeq) Iterator() Iterator {
+	return &seqIterator{s: s}
+}
+
+func (s *LazySeq) String() string {
+	return "<lazy-seq>"
+}
+
+type seqIterator struct {
+	s *LazySeq
+	// id is the goroutine iterating, computed once it realizes a node: an
+	// iterator is only used by one goroutine.
+	id int64
+}
+
+func (it *seqIterator) Next() (parser.Value, bool) {
+	if it.s == nil {
+		return nil, false
+	}
+	it.id = it.s.realize(it.id)
+	if it.s.empty {
+		it.s = nil
+		return nil, false
+	}
+	v := it.s.first
+	it.s = it.s.rest
+	return v, true
+}
+
+// isLazy reports whether any of the collections is a lazy sequence.
+func isLazy(colls ...interface{}) bool {
+	for _, coll := range colls {
+		if _, ok := coll.(*LazySeq); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// LazySeqForm implements the 'lazy-seq' special form: (lazy-seq body...).
+// The body is only evaluated when the first element of the sequence is
+// needed; it must return a collection or nil.
+func LazySeqForm(ctx *Context, args ...parser.Value) parser.Value {
+	return parser.NewAny(lazySeq(func() *LazySeq {
+		v := evalBody(ctx, args).Value()
+		if v == nil {
+			return nil
+		}
+		return toSeq(v)
+	}), nil)
+}
+
+// Seq implements the seq function, returning coll as a lazy sequence. This
+// can be used to read channels, csv readers or scanners on demand.
+func Seq(coll interface{}) *LazySeq {
+	return toSeq(coll)
+}
+
+// IterateSeq implements the iterate function: (iterate fn x) returns the
+// infinite lazy sequence x, (fn x), (fn (fn x))...
+func IterateSeq(fn interface{}, x interface{}) *LazySeq {
+	var next func(v parser.Value) *LazySeq
+	next = func(v parser.Value) *LazySeq {
+		return consSeq(v, lazySeq(func() *LazySeq {
+			return next(Apply(fn, v))
+		}))
+	}
+	return next(parser.NewAny(x, nil))
+}
+
+// Repeat implements the repeat function: (repeat x) returns an infinite lazy
+// sequence of x while (repeat n x) only returns n times x.
+func Repeat(args ...interface{}) *LazySeq {
+	var n int64 = -1
+	var x interface{}
+	switch len(args) {
+	case 1:
+		x = args[0]
+	case 2:
+		count, ok := args[0].(int64)
+		if !ok {
+			panic("Function 'repeat' count must be an integer")
+		}
+		n, x = count, args[1]
+	default:
+		panic("Function 'repeat' should take one or two arguments")
+	}
+
+	v := parser.NewAny(x, nil)
+	return NewLazySeq(IteratorFunc(func() (parser.Value, bool) {
+		if n == 0 {
+			return nil, false
+		}
+		if n > 0 {
+			n--
+		}
+		return v, true
+	}))
+}
+
+// Cycle implements the cycle function, returning an infinite lazy sequence
+// repeating the elements of coll.
+func Cycle(coll interface{}) *LazySeq {
+	var values []parser.Value
+	i := 0
+	return lazySeq(func() *LazySeq {
+		values = toValues(coll)
+		if len(values) == 0 {
+			return nil
+		}
+		return NewLazySeq(IteratorFunc(func() (parser.Value, bool) {
+			v := values[i%len(values)]
+			i++
+			return v, true
+		}))
+	})
+}
+
+// lazyMap is the lazy version of Map.
+func lazyMap(fn interface{}, colls []interface{}) *LazySeq {
+	its := make([]Iterator, len(colls))
+	for i, coll := range colls {
+		its[i] = MustIterate(coll)
+	}
+	return NewLazySeq(IteratorFunc(func() (parser.Value, bool) {
+		args := make([]parser.Value, len(its))
+		for i, it := range its {
+			v, ok := it.Next()
+			if !ok {
+				return nil, false
+			}
+			args[i] = v
+		}
+		return Apply(fn, args...), true
+	}))
+}
+
+// lazyFilter is the lazy version of Filter.
+func lazyFilter(pred interface{}, coll interface{}) *LazySeq {
+	it := MustIterate(coll)
+	return NewLazySeq(IteratorFunc(func() (parser.Value, bool) {
+		for v, ok := it.Next(); ok; v, ok = it.Next() {
+			if Truthy(Apply(pred, v).Value()) {
+				return v, true
+			}
+		}
+		return nil, false
+	}))
+}
+
+// TakeWhile implements the take-while function: (take-while pred coll). It
+// returns the elements of coll until pred is false. The result is lazy if coll
+// is lazy.
+func TakeWhile(pred interface{}, coll interface{}) interface{} {
+	it := MustIterate(coll)
+	done := false
+	next := IteratorFunc(func() (parser.Value, bool) {
+		if done {
+			return nil, false
+		}
+		v, ok := it.Next()
+		if !ok || !Truthy(Apply(pred, v).Value()) {
+			done = true
+			return nil, false
+		}
+		return v, true
+	})
+	if isLazy(coll) {
+		return NewLazySeq(next)
+	}
+	return toValues(next)
+}
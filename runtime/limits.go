@@ -0,0 +1,336 @@
+package runtime
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rumlang/rum/parser"
+)
+
+// Limits restricts the evaluations of a context, to safely run untrusted
+// code. A zero field means no limit.
+type Limits struct {
+	// Steps is the maximum number of evaluation steps: each expression
+	// evaluated by the interpreter, each call and loop iteration of compiled
+	// code.
+	Steps int64
+	// Depth is the maximum number of nested evaluations, which grows with the
+	// calls which are not in tail position.
+	Depth int
+	// Timeout is the maximum wall time of an evaluation.
+	Timeout time.Duration
+	// Memory is the maximum number of bytes an evaluation allocates, as
+	// estimated by the runtime: the strings and collections returned by
+	// functions, the lists built by array and for, and the bindings. Values
+	// are a budget for the whole evaluation: those which are no longer
+	// referenced still count. Bindings count while they exist: those of a
+	// scope are released when it ends, and rebinding a name is free.
+	Memory int64
+}
+
+// SetLimits sets the limits of the evaluations of the context and its
+// children. Exceeding them raises an *Error with the code ErrStepLimit,
+// ErrDepthLimit, ErrTimeout or ErrMemoryLimit.
+func (c *Context) SetLimits(limits Limits) {
+	c.root().limits = limits
+}
+
+// TryEvalContext is similar to TryEval, but the evaluation is also stopped
+// when ctx is done, with an *Error of code ErrCanceled or ErrTimeout.
+//
+// The limits are shared by all the evaluations in the context which run at
+// the same time: nested ones (e.g., from Go functions called by the
+// evaluation), and the ones of other goroutines. Each of them is still
+// stopped when its own ctx is done or its own timeout expires, which also
+// stops the others with the same error. Go functions which block are not
+// interrupted, but receiving from a channel in a for form is.
+func (c *Context) TryEvalContext(ctx context.Context, input parser.Value) (parser.Value, error) {
+	end := c.root().begin(ctx)
+	defer end()
+	v, err := c.eval(input)
+	if err == nil && isRecur(v) {
+		err = &Error{Code: ErrRecur, Msg: recurMsg, Stack: []parser.Value{input}}
+	}
+	return v, err
+}
+
+// evaluation is the state of the evaluations running in a root context,
+// checked by the interpreter and compiled code.
+type evaluation struct {
+	// steps and allocated are first to be aligned for atomic operations.
+	steps     int64
+	allocated int64
+	depth     int32
+	ctx       context.Context
+	cancel    func()
+	done      <-chan struct{}
+	limits    Limits
+	// reason is the error of the call which stopped the evaluation, when it
+	// is not the one which started it.
+	reason atomic.Value
+	once   sync.Once
+	// users is the number of evaluations sharing this state. It is protected
+	// by the mutex of the root context.
+	users int
+}
+
+// current returns the state of the evaluations running in the root context c,
+// or nil.
+func (c *Context) current() *evaluation {
+	ev, _ := c.running.Load().(*evaluation)
+	return ev
+}
+
+// goContext returns the Go context of the evaluation running in c, to stop
+// the blocking operations of the Go functions with it.
+func (c *Context) goContext() context.Context {
+	if ev := c.root().current(); ev != nil {
+		return ev.ctx
+	}
+	return context.Background()
+}
+
+// begin starts an evaluation in the root context c, stopped when ctx is done,
+// and returns the function to call when it ends. If an evaluation is already
+// running, the new one joins it and stops it when ctx is done.
+func (c *Context) begin(ctx context.Context) func() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ev := c.current()
+	if ev == nil {
+		var cancel func()
+		if c.limits.Timeout > 0 {
+			ctx, cancel = context.WithTimeout(ctx, c.limits.Timeout)
+		} else {
+			ctx, cancel = context.WithCancel(ctx)
+		}
+		ev = &evaluation{ctx: ctx, cancel: cancel, done: ctx.Done(), limits: c.limits}
+		c.running.Store(ev)
+		ev.users++
+		return c.end(ev, func() {})
+	}
+	ev.users++
+
+	cancel := func() {}
+	if ev.limits.Timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, ev.limits.Timeout)
+	}
+	if ctx.Done() == nil {
+		return c.end(ev, cancel)
+	}
+	ended, watched := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(watched)
+		select {
+		case <-ctx.Done():
+			ev.stop(ctx)
+		case <-ended:
+		}
+	}()
+	return c.end(ev, func() {
+		close(ended)
+		<-watched
+		cancel()
+	})
+}
+
+// end returns the function ending a call of the evaluation ev, which releases
+// the resources of the call with done.
+func (c *Context) end(ev *evaluation, done func()) func() {
+	return func() {
+		done()
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		ev.users--
+		if ev.users == 0 {
+			c.running.Store((*evaluation)(nil))
+			ev.cancel()
+		}
+	}
+}
+
+// stop stops the evaluation because ctx, the context of one of the calls which
+// joined it, is done - unless it is already stopped.
+func (ev *evaluation) stop(ctx context.Context) {
+	ev.once.Do(func() {
+		if ev.ctx.Err() == nil {
+			ev.reason.Store(ev.stoppedBy(ctx))
+			ev.cancel()
+		}
+	})
+}
+
+// step counts an evaluation step and checks whether the evaluation must stop.
+func (ev *evaluation) step() *Error {
+	if ev == nil {
+		return nil
+	}
+	if steps := atomic.AddInt64(&ev.steps, 1); ev.limits.Steps > 0 && steps > ev.limits.Steps {
+		return &Error{
+			Code: ErrStepLimit,
+			Msg:  fmt.Sprintf("evaluation exceeded the limit of %d steps", ev.limits.Steps),
+		}
+	}
+	select {
+	case <-ev.done:
+		return ev.stopped()
+	default:
+		return nil
+	}
+}
+
+// enter checks the depth of a nested evaluation. leave must be called when it
+// returns, if it did not fail.
+func (ev *evaluation) enter() *Error {
+	if ev == nil {
+		return nil
+	}
+	if depth := atomic.AddInt32(&ev.depth, 1); ev.limits.Depth > 0 && int(depth) > ev.limits.Depth {
+		atomic.AddInt32(&ev.depth, -1)
+		return &Error{
+			Code: ErrDepthLimit,
+			Msg:  fmt.Sprintf("evaluation exceeded the limit of %d nested calls", ev.limits.Depth),
+		}
+	}
+	return nil
+}
+
+func (ev *evaluation) leave() {
+	if ev != nil {
+		atomic.AddInt32(&ev.depth, -1)
+	}
+}
+
+// stopped returns the error of an evaluation whose context is done.
+func (ev *evaluation) stopped() *Error {
+	if err, ok := ev.reason.Load().(*Error); ok {
+		return &Error{Code: err.Code, Msg: err.Msg}
+	}
+	return ev.stoppedBy(ev.ctx)
+}
+
+// stoppedBy returns the error of the evaluation stopped because ctx is done.
+func (ev *evaluation) stoppedBy(ctx context.Context) *Error {
+	if ctx.Err() == context.DeadlineExceeded {
+		msg := "evaluation deadline exceeded"
+		if ev.limits.Timeout > 0 {
+			msg = fmt.Sprintf("evaluation exceeded the time limit of %s", ev.limits.Timeout)
+		}
+		return &Error{Code: ErrTimeout, Msg: msg}
+	}
+	return &Error{Code: ErrCanceled, Msg: "evaluation canceled"}
+}
+
+// Estimated sizes of a binding in a context, and of a parser.Value holding
+// an Any.
+const (
+	bindingSize = 64
+	valueSize   = 40
+)
+
+// alloc accounts for bytes allocated by the evaluation. It panics with an
+// *Error when the memory quota is exceeded.
+func (ev *evaluation) alloc(bytes int64) {
+	if ev == nil || ev.limits.Memory <= 0 {
+		return
+	}
+	if allocated := atomic.AddInt64(&ev.allocated, bytes); allocated > ev.limits.Memory {
+		panic(&Error{
+			Code: ErrMemoryLimit,
+			Msg:  fmt.Sprintf("evaluation exceeded the memory quota of %d bytes", ev.limits.Memory),
+		})
+	}
+}
+
+// free gives back bytes accounted by alloc.
+func (ev *evaluation) free(bytes int64) {
+	if ev == nil || ev.limits.Memory <= 0 {
+		return
+	}
+	atomic.AddInt64(&ev.allocated, -bytes)
+}
+
+// bind accounts for a new binding of the context c, until its scope ends.
+func (c *Context) bind() {
+	ev := c.root().current()
+	if ev == nil || ev.limits.Memory <= 0 {
+		return
+	}
+	c.bound += bindingSize
+	ev.alloc(bindingSize)
+}
+
+// release gives back the bindings of the context c, whose scope ended.
+func (c *Context) release() {
+	if c.bound == 0 {
+		return
+	}
+	c.root().current().free(c.bound)
+	c.bound = 0
+}
+
+// allocValues accounts for a list of n values, before it is built.
+func (ev *evaluation) allocValues(n int64) {
+	if n > math.MaxInt64/valueSize {
+		n = math.MaxInt64 / valueSize
+	}
+	ev.alloc(n * valueSize)
+}
+
+// accountedFunc is a builtin which charges the memory quota for what it
+// allocates before allocating it, instead of being charged for its result.
+type accountedFunc func(args []parser.Value, ref *parser.SourceRef) parser.Value
+
+func (f accountedFunc) call(args []parser.Value, ref *parser.SourceRef) parser.Value {
+	return f(args, ref)
+}
+
+// accounted returns fn as a builtin of the root context c. fn is a Go
+// function whose first parameter is the running evaluation, to charge.
+func (c *Context) accounted(fn interface{}) accountedFunc {
+	return func(args []parser.Value, ref *parser.SourceRef) parser.Value {
+		ev := parser.NewAny(c.current(), nil)
+		return call(parser.NewAny(fn, nil), append([]parser.Value{ev}, args...), ref)
+	}
+}
+
+// allocValue accounts for the allocation of v.
+func (ev *evaluation) allocValue(v parser.Value) {
+	if ev == nil || ev.limits.Memory <= 0 || v == nil {
+		return
+	}
+	ev.alloc(sizeOf(v.Value()))
+}
+
+// sizeOf estimates the number of bytes used by v, without the values it
+// refers to: strings and collections are counted, scalars are free.
+func sizeOf(v interface{}) int64 {
+	switch data := v.(type) {
+	case nil:
+		return 0
+	case string:
+		return int64(len(data))
+	case []parser.Value:
+		return int64(len(data)) * valueSize
+	case *Record:
+		return int64(len(data.values)) * valueSize
+	}
+
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.String:
+		return int64(rv.Len())
+	case reflect.Slice, reflect.Array:
+		return int64(rv.Len()) * int64(rv.Type().Elem().Size())
+	case reflect.Map:
+		t := rv.Type()
+		return int64(rv.Len()) * int64(t.Key().Size()+t.Elem().Size())
+	}
+	return 0
+}
@@ -0,0 +1,333 @@
+package runtime
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+
+	"github.com/rumlang/rum/parser"
+)
+
+// The match form tests a value against a sequence of clauses:
+//
+//	(match expr
+//	  (pattern body...)
+//	  (pattern :when guard body...)
+//	  ...)
+//
+// The body of the first clause whose pattern matches - and whose guard, if
+// any, is true - is evaluated with the pattern names bound. Patterns are:
+//
+//	_                        matches anything
+//	1, 2.5, "s", :k          literal values; nil, true and false too
+//	name                     matches anything and binds it to name
+//	(p1 p2 & rest)           lists and Go slices with this shape
+//	(:keys a (p "key"))      Go maps with all the keys present
+//	(:type name p)           values of the provided type, name being either
+//	                         a type registered with RegisterType or a Go
+//	                         type name such as int64
+//
+// Patterns are compiled once per match form and a warning is emitted when the
+// clauses are not exhaustive.
+
+// matcher tests a value against a compiled pattern, adding the bound names to
+// env when it matches.
+type matcher func(ctx *Context, v parser.Value, env map[parser.Symbol]parser.Value) bool
+
+// matchClause is a compiled clause of a match form.
+type matchClause struct {
+	match matcher
+	guard parser.Value
+	body  []parser.Value
+}
+
+// patternCompiler holds the state while compiling the pattern of one clause.
+type patternCompiler struct {
+	// names bound by the pattern, to detect duplicates.
+	names map[parser.Identifier]bool
+	// irrefutable is true when the pattern matches any value.
+	irrefutable bool
+	// literal is set when the whole pattern is a literal value.
+	literal    interface{}
+	hasLiteral bool
+}
+
+// Match implements the 'match' special form.
+func Match(ctx *Context, args ...parser.Value) parser.Value {
+	if len(args) < 1 {
+		panic("Invalid arguments")
+	}
+
+	v := ctx.MustEval(args[0])
+	for _, c := range compileMatch(ctx, args) {
+		env := map[parser.Symbol]parser.Value{}
+		if !c.match(ctx, v, env) {
+			continue
+		}
+		nested := NewContext(ctx)
+		for sym, bound := range env {
+			nested.define(sym, bound, true)
+		}
+		if c.guard != nil && !Truthy(nested.MustEval(c.guard).Value()) {
+			continue
+		}
+		return tailBody(nested, c.body)
+	}
+
+	panic(&Error{
+		Code: ErrNoMatch,
+		Msg:  fmt.Sprintf("no clause matched value %v", v.Value()),
+	})
+}
+
+// matchCacheSize is the maximum number of match forms whose compiled clauses
+// are cached, as evaluated code can create any number of forms.
+const matchCacheSize = 1024
+
+// matchKey identifies a match form by the elements of its list, the same
+// whatever its source reference.
+type matchKey struct {
+	args *parser.Value
+	n    int
+}
+
+// matchCache caches the compiled clauses of the match forms. It is emptied
+// when it is full.
+type matchCache struct {
+	mu      sync.Mutex
+	clauses map[matchKey][]matchClause
+}
+
+func (m *matchCache) load(key matchKey) ([]matchClause, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	clauses, ok := m.clauses[key]
+	return clauses, ok
+}
+
+func (m *matchCache) store(key matchKey, clauses []matchClause) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.clauses == nil || len(m.clauses) >= matchCacheSize {
+		m.clauses = map[matchKey][]matchClause{}
+	}
+	m.clauses[key] = clauses
+}
+
+// compileMatch compiles the clauses of a match form. Compiled forms are
+// cached on the root context.
+func compileMatch(ctx *Context, args []parser.Value) []matchClause {
+	if len(args) < 2 {
+		return nil
+	}
+	key := matchKey{args: &args[0], n: len(args)}
+	cache := &ctx.root().matches
+	if clauses, ok := cache.load(key); ok {
+		return clauses
+	}
+
+	var clauses []matchClause
+	exhaustive := false
+	literals := map[interface{}]bool{}
+	for _, arg := range args[1:] {
+		elts, ok := arg.Value().([]parser.Value)
+		if !ok || len(elts) == 0 {
+			panic(fmt.Sprintf("Invalid match clause: %s", arg))
+		}
+		pc := &patternCompiler{names: map[parser.Identifier]bool{}}
+		c := matchClause{match: pc.compile(elts[0]), body: elts[1:]}
+		if len(c.body) > 0 && isMarker(c.body[0], ":when") {
+			if len(c.body) < 2 {
+				panic(fmt.Sprintf("Missing guard after :when in %s", arg))
+			}
+			c.guard = c.body[1]
+			c.body = c.body[2:]
+		}
+		if c.guard == nil {
+			exhaustive = exhaustive || pc.irrefutable
+			if pc.hasLiteral {
+				literals[pc.literal] = true
+			}
+		}
+		clauses = append(clauses, c)
+	}
+
+	if !exhaustive && !(literals[true] && literals[false]) {
+		ctx.warn(args[0].Ref(), "match on %s is not exhaustive - add a _ clause", args[0])
+	}
+
+	cache.store(key, clauses)
+	return clauses
+}
+
+// literal returns a matcher testing equality with v.
+func (pc *patternCompiler) literalMatcher(v interface{}) matcher {
+	pc.literal, pc.hasLiteral = v, true
+	return func(ctx *Context, value parser.Value, env map[parser.Symbol]parser.Value) bool {
+		return Equal(v, value.Value())
+	}
+}
+
+// compile compiles a single pattern.
+func (pc *patternCompiler) compile(pattern parser.Value) matcher {
+	switch p := pattern.Value().(type) {
+	case parser.Identifier:
+		switch {
+		case p == "_":
+			pc.irrefutable = true
+			return func(*Context, parser.Value, map[parser.Symbol]parser.Value) bool {
+				return true
+			}
+		case p == "nil":
+			return pc.literalMatcher(nil)
+		case p == "true":
+			return pc.literalMatcher(true)
+		case p == "false":
+			return pc.literalMatcher(false)
+		case IsKeyword(p):
+			return pc.literalMatcher(p)
+		}
+		if pc.names[p] {
+			panic(fmt.Sprintf("Name %s bound twice in match pattern", p))
+		}
+		pc.names[p] = true
+		pc.irrefutable = true
+		sym, _ := parser.SymbolOf(pattern)
+		return func(ctx *Context, v parser.Value, env map[parser.Symbol]parser.Value) bool {
+			env[sym] = v
+			return true
+		}
+	case []parser.Value:
+		if len(p) > 0 && isMarker(p[0], ":keys") {
+			return pc.compileMap(pattern, p[1:])
+		}
+		if len(p) > 0 && isMarker(p[0], ":type") {
+			return pc.compileType(pattern, p[1:])
+		}
+		return pc.compileSequence(pattern, p)
+	case int64, float64, string:
+		return pc.literalMatcher(p)
+	default:
+		panic(fmt.Sprintf("Invalid match pattern %s", pattern))
+	}
+}
+
+// sub compiles a nested pattern; only the top-level pattern decides whether
+// the clause is irrefutable or a literal.
+func (pc *patternCompiler) sub(pattern parser.Value) matcher {
+	sub := &patternCompiler{names: pc.names}
+	return sub.compile(pattern)
+}
+
+// compileSequence compiles a (p1 p2 & rest) pattern.
+func (pc *patternCompiler) compileSequence(pattern parser.Value, elts []parser.Value) matcher {
+	var elements []matcher
+	var rest matcher
+	for i := 0; i < len(elts); i++ {
+		if isMarker(elts[i], "&") {
+			if i+1 != len(elts)-1 {
+				panic(fmt.Sprintf("Invalid rest pattern in %s", pattern))
+			}
+			rest = pc.sub(elts[i+1])
+			break
+		}
+		elements = append(elements, pc.sub(elts[i]))
+	}
+
+	return func(ctx *Context, v parser.Value, env map[parser.Symbol]parser.Value) bool {
+		values, ok := toList(v.Value())
+		if !ok || len(values) < len(elements) {
+			return false
+		}
+		if rest == nil && len(values) != len(elements) {
+			return false
+		}
+		for i, m := range elements {
+			if !m(ctx, values[i], env) {
+				return false
+			}
+		}
+		if rest != nil {
+			return rest(ctx, parser.NewAny(values[len(elements):], v.Ref()), env)
+		}
+		return true
+	}
+}
+
+// compileMap compiles a (:keys a (p "key")) pattern.
+func (pc *patternCompiler) compileMap(pattern parser.Value, elts []parser.Value) matcher {
+	type entry struct {
+		key   string
+		match matcher
+	}
+	var entries []entry
+	for _, elt := range elts {
+		switch e := elt.Value().(type) {
+		case parser.Identifier:
+			entries = append(entries, entry{string(e), pc.sub(elt)})
+		case []parser.Value:
+			if len(e) != 2 {
+				panic(fmt.Sprintf("Invalid entry %s in %s - expected (pattern key)", elt, pattern))
+			}
+			key, ok := e[1].Value().(string)
+			if !ok {
+				key = e[1].String()
+			}
+			entries = append(entries, entry{key, pc.sub(e[0])})
+		default:
+			panic(fmt.Sprintf("Invalid entry %s in %s", elt, pattern))
+		}
+	}
+
+	return func(ctx *Context, v parser.Value, env map[parser.Symbol]parser.Value) bool {
+		m := reflect.ValueOf(v.Value())
+		if r, ok := v.Value().(*Record); ok {
+			m = reflect.ValueOf(r.Map())
+		}
+		if m.Kind() != reflect.Map {
+			return false
+		}
+		for _, e := range entries {
+			value, ok := mapLookup(m, e.key)
+			if !ok || !e.match(ctx, value, env) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// compileType compiles a (:type name pattern) pattern.
+func (pc *patternCompiler) compileType(pattern parser.Value, elts []parser.Value) matcher {
+	if len(elts) < 1 || len(elts) > 2 {
+		panic(fmt.Sprintf("Invalid type pattern %s - expected (:type name pattern)", pattern))
+	}
+	name := elts[0].String()
+	inner := func(*Context, parser.Value, map[parser.Symbol]parser.Value) bool {
+		return true
+	}
+	if len(elts) == 2 {
+		inner = pc.sub(elts[1])
+	}
+
+	return func(ctx *Context, v parser.Value, env map[parser.Symbol]parser.Value) bool {
+		return IsType(ctx, v.Value(), name) && inner(ctx, v, env)
+	}
+}
+
+// IsType reports whether v is of the type with the provided name: either a
+// type registered with RegisterType (a pointer to it is accepted too) or the
+// Go name of the type of v, as returned by the type function.
+func IsType(ctx *Context, v interface{}, name string) bool {
+	if t, ok := ctx.LookupType(name); ok {
+		if v == nil {
+			return false
+		}
+		vt := reflect.TypeOf(v)
+		if t.Kind() == reflect.Interface {
+			return vt.Implements(t)
+		}
+		return vt == t || (vt.Kind() == reflect.Ptr && vt.Elem() == t)
+	}
+	return Type(v) == name
+}
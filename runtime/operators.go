@@ -139,6 +139,13 @@ func OpEqual(values ...interface{}) interface{} {
 			}
 		}
 		return true
+	case *Record:
+		for _, v := range values[1:] {
+			if !Equal(values[0], v) {
+				return false
+			}
+		}
+		return true
 	default:
 		panic(fmt.Sprintf("Unable to compare values of type %T", values[0]))
 	}
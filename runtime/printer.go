@@ -0,0 +1,184 @@
+package runtime
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/rumlang/rum/parser"
+)
+
+// PrString returns the readable representation of v, as Rum source which the
+// parser reads back: strings are quoted, lists are in parentheses, records
+// and atoms are written as calls of their constructor (e.g., (Point 1 2)),
+// and maps as lists of (key value) pairs. The values without a literal, like
+// functions, are written as a <...> description, which is not readable. It is
+// what pr and prn print.
+func PrString(v interface{}) string {
+	var b strings.Builder
+	writeValue(&b, v, true)
+	return b.String()
+}
+
+// DisplayString returns the representation of v for humans: it is similar to
+// PrString, but strings are not quoted. It is what print and println print.
+func DisplayString(v interface{}) string {
+	var b strings.Builder
+	writeValue(&b, v, false)
+	return b.String()
+}
+
+// printLength is the maximum number of elements of a lazy sequence written by
+// the printer, as it can be infinite. The following ones are replaced by ...
+const printLength = 100
+
+// writeValue writes the representation of v to b, readable or not.
+func writeValue(b *strings.Builder, v interface{}, readable bool) {
+	switch data := v.(type) {
+	case nil:
+		b.WriteString("nil")
+	case parser.Value:
+		writeValue(b, data.Value(), readable)
+	case bool:
+		b.WriteString(strconv.FormatBool(data))
+	case int64:
+		b.WriteString(strconv.FormatInt(data, 10))
+	case float64:
+		b.WriteString(formatFloat(data))
+	case string:
+		if readable {
+			b.WriteString(parser.Quote(data))
+		} else {
+			b.WriteString(data)
+		}
+	case parser.Identifier:
+		b.WriteString(string(data))
+	case []parser.Value:
+		writeList(b, len(data), func(i int) interface{} { return data[i] }, readable)
+	case *LazySeq:
+		var elts []interface{}
+		it := data.Iterator()
+		for v, ok := it.Next(); ok; v, ok = it.Next() {
+			if len(elts) == printLength {
+				elts = append(elts, parser.Identifier("..."))
+				break
+			}
+			elts = append(elts, v)
+		}
+		writeList(b, len(elts), func(i int) interface{} { return elts[i] }, readable)
+	case *Record:
+		elts := append([]interface{}{parser.Identifier(data.Type.Name)}, data.values...)
+		writeList(b, len(elts), func(i int) interface{} { return elts[i] }, readable)
+	case *Atom:
+		writeList(b, 2, func(i int) interface{} {
+			if i == 0 {
+				return parser.Identifier("atom")
+			}
+			return data.Deref()
+		}, readable)
+	case fmt.Stringer:
+		b.WriteString(data.String())
+	default:
+		writeReflect(b, reflect.ValueOf(v), readable)
+	}
+}
+
+// writeReflect writes the Go collections as their Rum equivalent, and the
+// other values with their default format.
+func writeReflect(b *strings.Builder, rv reflect.Value, readable bool) {
+	switch rv.Kind() {
+	case reflect.Slice, reflect.Array:
+		writeList(b, rv.Len(), func(i int) interface{} { return rv.Index(i).Interface() }, readable)
+	case reflect.Map:
+		// The entries are sorted, for the output to be deterministic.
+		entries := make([][2]string, 0, rv.Len())
+		iter := rv.MapRange()
+		for iter.Next() {
+			var key, value strings.Builder
+			writeValue(&key, iter.Key().Interface(), readable)
+			writeValue(&value, iter.Value().Interface(), readable)
+			entries = append(entries, [2]string{key.String(), value.String()})
+		}
+		sort.Slice(entries, func(i, j int) bool { return entries[i][0] < entries[j][0] })
+		b.WriteString("(")
+		for i, entry := range entries {
+			if i != 0 {
+				b.WriteString(" ")
+			}
+			fmt.Fprintf(b, "(%s %s)", entry[0], entry[1])
+		}
+		b.WriteString(")")
+	case reflect.String:
+		writeValue(b, rv.String(), readable)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32:
+		writeValue(b, rv.Int(), readable)
+	case reflect.Float32:
+		writeValue(b, rv.Float(), readable)
+	default:
+		fmt.Fprintf(b, "%v", rv.Interface())
+	}
+}
+
+func writeList(b *strings.Builder, n int, elt func(int) interface{}, readable bool) {
+	b.WriteString("(")
+	for i := 0; i < n; i++ {
+		if i != 0 {
+			b.WriteString(" ")
+		}
+		writeValue(b, elt(i), readable)
+	}
+	b.WriteString(")")
+}
+
+// formatFloat formats f so that it is read back as a float, not an integer.
+func formatFloat(f float64) string {
+	s := strconv.FormatFloat(f, 'g', -1, 64)
+	if math.IsInf(f, 0) || math.IsNaN(f) || strings.ContainsAny(s, ".e") {
+		return s
+	}
+	return s + ".0"
+}
+
+// fprint writes the display representation of args to w, separated by spaces.
+func fprint(w io.Writer, args ...interface{}) {
+	for i, v := range args {
+		if i != 0 {
+			fmt.Fprint(w, " ")
+		}
+		fmt.Fprint(w, DisplayString(v))
+	}
+}
+
+// fpr writes the readable representation of args to w, separated by spaces.
+func fpr(w io.Writer, args ...interface{}) {
+	for i, v := range args {
+		if i != 0 {
+			fmt.Fprint(w, " ")
+		}
+		fmt.Fprint(w, PrString(v))
+	}
+}
+
+// PrStr implements the pr-str function, returning the readable
+// representations of its arguments separated by spaces.
+func PrStr(args ...interface{}) string {
+	var b strings.Builder
+	fpr(&b, args...)
+	return b.String()
+}
+
+// Str implements the str function, concatenating the display representations
+// of its arguments. nil is the empty string.
+func Str(args ...interface{}) string {
+	var b strings.Builder
+	for _, v := range args {
+		if v != nil {
+			writeValue(&b, v, false)
+		}
+	}
+	return b.String()
+}
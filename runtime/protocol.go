@@ -0,0 +1,285 @@
+package runtime
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/rumlang/rum/parser"
+)
+
+// defaultKey is the type name or dispatch value of the implementation used
+// when no other matches.
+const defaultKey = parser.Identifier(":default")
+
+// Protocol is a named set of methods, declared with defprotocol, which types
+// implement with extend-type. Methods dispatch on the type of their first
+// argument.
+type Protocol struct {
+	Name    string
+	Methods []string
+	ctx     *Context
+
+	mu sync.RWMutex
+	// types lists the extended type names, in the order of extend-type.
+	types []string
+	impls map[string]map[string]*Function
+}
+
+func (p *Protocol) String() string {
+	return fmt.Sprintf("<protocol %s>", p.Name)
+}
+
+// typeName returns the name of the type of v used to find implementations:
+// the record name for records, nil for nil and the Go type otherwise.
+func typeName(v interface{}) string {
+	if v == nil {
+		return "nil"
+	}
+	return Type(v)
+}
+
+// implementation returns the implementation of method for the type of v, or
+// nil. The type name is tried first, then each extended type in order (which
+// handles registered Go types, pointers and interfaces) and finally :default.
+// An empty method returns any implementation of the protocol.
+func (p *Protocol) implementation(v interface{}, method string) *Function {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	names := []string{typeName(v)}
+	for _, name := range p.types {
+		if name != string(defaultKey) && name != names[0] && IsType(p.ctx, v, name) {
+			names = append(names, name)
+		}
+	}
+	names = append(names, string(defaultKey))
+
+	for _, name := range names {
+		impl, ok := p.impls[name]
+		if !ok {
+			continue
+		}
+		if method == "" {
+			for _, fn := range impl {
+				return fn
+			}
+		}
+		if fn, ok := impl[method]; ok {
+			return fn
+		}
+	}
+	return nil
+}
+
+// Satisfies reports whether the type of v implements the protocol.
+func (p *Protocol) Satisfies(v interface{}) bool {
+	return p.implementation(v, "") != nil
+}
+
+// extend sets the implementation of the methods of the protocol for a type.
+func (p *Protocol) extend(name string, methods map[string]*Function) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	impl, ok := p.impls[name]
+	if !ok {
+		impl = map[string]*Function{}
+		p.impls[name] = impl
+		p.types = append(p.types, name)
+	}
+	for method, fn := range methods {
+		impl[method] = fn
+	}
+}
+
+// protocolMethod is a method of a protocol, dispatching on its first
+// argument.
+type protocolMethod struct {
+	protocol *Protocol
+	name     string
+}
+
+func (m *protocolMethod) String() string {
+	return fmt.Sprintf("<method %s/%s>", m.protocol.Name, m.name)
+}
+
+func (m *protocolMethod) call(args []parser.Value, ref *parser.SourceRef) parser.Value {
+	if len(args) == 0 {
+		panic(&Error{
+			Code: ErrArity,
+			Msg:  fmt.Sprintf("%s expects at least 1 argument, got 0", m.name),
+		})
+	}
+	fn := m.protocol.implementation(args[0].Value(), m.name)
+	if fn == nil {
+		panic(&Error{
+			Code: ErrNoMethod,
+			Msg:  fmt.Sprintf("No implementation of %s/%s for type %s", m.protocol.Name, m.name, typeName(args[0].Value())),
+		})
+	}
+	return fn.call(args, ref)
+}
+
+// DefProtocol implements the defprotocol builtin function:
+// (defprotocol Name method...). Each method is either a name or a list
+// starting with the name, e.g. (area shape); the rest is only informative. It
+// defines the protocol and a function for each method.
+func DefProtocol(ctx *Context, args ...parser.Value) parser.Value {
+	if len(args) < 1 {
+		panic("Invalid arguments")
+	}
+	name, ok := args[0].Value().(parser.Identifier)
+	if !ok {
+		panic("Invalid arguments")
+	}
+
+	p := &Protocol{Name: string(name), ctx: ctx, impls: map[string]map[string]*Function{}}
+	for _, arg := range args[1:] {
+		spec := arg
+		if elts, ok := arg.Value().([]parser.Value); ok && len(elts) > 0 {
+			spec = elts[0]
+		}
+		method, ok := spec.Value().(parser.Identifier)
+		if !ok {
+			panic(fmt.Sprintf("Invalid method %v in protocol %s", arg.Value(), name))
+		}
+		p.Methods = append(p.Methods, string(method))
+	}
+
+	ref := args[0].Ref()
+	for _, method := range p.Methods {
+		ctx.define(parser.Intern(method), parser.NewAny(&protocolMethod{p, method}, ref), false)
+	}
+	return ctx.define(name.Symbol(), parser.NewAny(p, ref), false)
+}
+
+// ExtendType implements the extend-type builtin function:
+// (extend-type Type Protocol (method (params...) body...)...). Type is a
+// record name, a Go type name as returned by type, a type registered with
+// RegisterType, nil or :default.
+func ExtendType(ctx *Context, args ...parser.Value) parser.Value {
+	if len(args) < 2 {
+		panic("Invalid arguments")
+	}
+	name, ok := args[0].Value().(string)
+	if !ok {
+		name = args[0].String()
+	}
+	p, ok := ctx.MustEval(args[1]).Value().(*Protocol)
+	if !ok {
+		panic(fmt.Sprintf("%s is not a protocol", args[1]))
+	}
+
+	methods := map[string]*Function{}
+	for _, arg := range args[2:] {
+		elts, ok := arg.Value().([]parser.Value)
+		if !ok || len(elts) < 2 {
+			panic(fmt.Sprintf("Invalid method %v - expected (name (params...) body...)", arg.Value()))
+		}
+		method, ok := elts[0].Value().(parser.Identifier)
+		if !ok || !p.hasMethod(string(method)) {
+			panic(fmt.Sprintf("%v is not a method of protocol %s", elts[0].Value(), p.Name))
+		}
+		methods[string(method)] = NewFunction(ctx, string(method), elts[1:])
+	}
+	p.extend(name, methods)
+	return parser.NewAny(p, nil)
+}
+
+func (p *Protocol) hasMethod(name string) bool {
+	for _, method := range p.Methods {
+		if method == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Satisfies implements the satisfies? function: (satisfies? Protocol v).
+func Satisfies(p *Protocol, v interface{}) bool {
+	return p.Satisfies(v)
+}
+
+// MultiFn is a multimethod, declared with defmulti. It calls the method
+// registered with defmethod for the value returned by its dispatch function.
+type MultiFn struct {
+	Name string
+	// dispatch is the dispatch function. A keyword looks up that key in the
+	// first argument.
+	dispatch interface{}
+
+	mu      sync.RWMutex
+	methods map[interface{}]*Function
+}
+
+func (m *MultiFn) String() string {
+	return fmt.Sprintf("<multimethod %s>", m.Name)
+}
+
+func (m *MultiFn) call(args []parser.Value, ref *parser.SourceRef) parser.Value {
+	var value interface{}
+	if kw, ok := m.dispatch.(parser.Identifier); ok && IsKeyword(kw) {
+		if len(args) == 0 {
+			panic(&Error{
+				Code: ErrArity,
+				Msg:  fmt.Sprintf("%s expects at least 1 argument, got 0", m.Name),
+			})
+		}
+		value = GetFn(args[0].Value(), kw)
+	} else {
+		value = Apply(m.dispatch, args...).Value()
+	}
+
+	m.mu.RLock()
+	fn, ok := m.methods[mapKey(value)]
+	if !ok {
+		fn, ok = m.methods[defaultKey]
+	}
+	m.mu.RUnlock()
+	if !ok {
+		panic(&Error{
+			Code: ErrNoMethod,
+			Msg:  fmt.Sprintf("No method of %s for dispatch value %v", m.Name, value),
+		})
+	}
+	return fn.call(args, ref)
+}
+
+// DefMulti implements the defmulti builtin function: (defmulti name dispatch).
+// dispatch is called with the arguments of each call to select the method;
+// it can also be a keyword, to dispatch on that key of the first argument.
+func DefMulti(ctx *Context, args ...parser.Value) parser.Value {
+	if len(args) != 2 {
+		panic("Invalid arguments")
+	}
+	name, ok := args[0].Value().(parser.Identifier)
+	if !ok {
+		panic("Invalid arguments")
+	}
+
+	m := &MultiFn{
+		Name:     string(name),
+		dispatch: ctx.MustEval(args[1]).Value(),
+		methods:  map[interface{}]*Function{},
+	}
+	return ctx.define(name.Symbol(), parser.NewAny(m, args[0].Ref()), false)
+}
+
+// DefMethod implements the defmethod builtin function:
+// (defmethod name value (params...) body...). It adds the method called when
+// the dispatch function returns value; :default is used when no other method
+// matches.
+func DefMethod(ctx *Context, args ...parser.Value) parser.Value {
+	if len(args) < 3 {
+		panic("Invalid arguments")
+	}
+	m, ok := ctx.MustEval(args[0]).Value().(*MultiFn)
+	if !ok {
+		panic(fmt.Sprintf("%s is not a multimethod", args[0]))
+	}
+	value := mapKey(ctx.MustEval(args[1]).Value())
+
+	fn := NewFunction(ctx, m.Name, args[2:])
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.methods[value] = fn
+	return parser.NewAny(m, nil)
+}
@@ -0,0 +1,287 @@
+package runtime
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/rumlang/rum/parser"
+)
+
+// RecordType describes a record type declared with defrecord.
+type RecordType struct {
+	Name   string
+	Fields []string
+	index  map[string]int
+}
+
+// NewRecordType creates a record type with the provided name and fields.
+func NewRecordType(name string, fields ...string) *RecordType {
+	t := &RecordType{Name: name, Fields: fields, index: map[string]int{}}
+	for i, field := range fields {
+		if _, ok := t.index[field]; ok {
+			panic(fmt.Sprintf("Duplicate field %s in record %s", field, name))
+		}
+		t.index[field] = i
+	}
+	return t
+}
+
+// New creates a record of this type. values are the values of the fields, in
+// the order of their declaration.
+func (t *RecordType) New(values ...interface{}) *Record {
+	if len(values) != len(t.Fields) {
+		panic(&Error{
+			Code: ErrArity,
+			Msg:  fmt.Sprintf("%s expects %d arguments, got %d", t.Name, len(t.Fields), len(values)),
+		})
+	}
+	return &Record{Type: t, values: append([]interface{}{}, values...)}
+}
+
+// Record is an immutable instance of a record type.
+type Record struct {
+	Type   *RecordType
+	values []interface{}
+}
+
+// fieldName returns the name of a field from a string, an identifier or a
+// keyword.
+func fieldName(key interface{}) (string, bool) {
+	switch k := key.(type) {
+	case string:
+		return k, true
+	case parser.Identifier:
+		return strings.TrimPrefix(string(k), ":"), true
+	}
+	return "", false
+}
+
+// Get returns the value of the field with the provided name, which can also be
+// a keyword, and whether the record has such a field.
+func (r *Record) Get(name string) (interface{}, bool) {
+	name, _ = fieldName(parser.Identifier(name))
+	i, ok := r.Type.index[name]
+	if !ok {
+		return nil, false
+	}
+	return r.values[i], true
+}
+
+// Assoc returns a copy of the record with the field name set to v.
+func (r *Record) Assoc(name string, v interface{}) *Record {
+	name, _ = fieldName(parser.Identifier(name))
+	i, ok := r.Type.index[name]
+	if !ok {
+		panic(fmt.Sprintf("Record %s has no field %s", r.Type.Name, name))
+	}
+	c := r.Type.New(r.values...)
+	c.values[i] = v
+	return c
+}
+
+// Map returns the fields of the record as a map.
+func (r *Record) Map() map[string]interface{} {
+	m := make(map[string]interface{}, len(r.values))
+	for i, field := range r.Type.Fields {
+		m[field] = r.values[i]
+	}
+	return m
+}
+
+// Equal reports whether both records have the same type and equal fields.
+func (r *Record) Equal(o *Record) bool {
+	if r.Type != o.Type {
+		return false
+	}
+	for i := range r.values {
+		if !Equal(r.values[i], o.values[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *Record) String() string {
+	return PrString(r)
+}
+
+// DefRecord implements the defrecord builtin function:
+// (defrecord Name (field...)). It defines the constructor (Name field...), the
+// predicate (Name? v) and an accessor (Name-field r) for each field.
+func DefRecord(ctx *Context, args ...parser.Value) parser.Value {
+	if len(args) != 2 {
+		panic("Invalid arguments")
+	}
+
+	name, ok := args[0].Value().(parser.Identifier)
+	if !ok {
+		panic("Invalid arguments")
+	}
+	elts, ok := args[1].Value().([]parser.Value)
+	if !ok {
+		panic("Invalid arguments")
+	}
+	fields := make([]string, len(elts))
+	for i, elt := range elts {
+		field, ok := elt.Value().(parser.Identifier)
+		if !ok || IsKeyword(field) {
+			panic(fmt.Sprintf("Invalid field %v in record %s", elt.Value(), name))
+		}
+		fields[i] = string(field)
+	}
+
+	t := NewRecordType(string(name), fields...)
+	ref := args[0].Ref()
+	ctx.define(name.Symbol(), parser.NewAny(t.New, ref), false)
+	ctx.define((name + "?").Symbol(), parser.NewAny(func(v interface{}) bool {
+		r, ok := v.(*Record)
+		return ok && r.Type == t
+	}, ref), false)
+	for i, field := range fields {
+		i, field := i, field
+		ctx.define(parser.Intern(fmt.Sprintf("%s-%s", name, field)), parser.NewAny(func(v interface{}) interface{} {
+			r, ok := v.(*Record)
+			if !ok || r.Type != t {
+				panic(fmt.Sprintf("Expected a %s record, got %T", name, v))
+			}
+			return r.values[i]
+		}, ref), false)
+	}
+	return parser.NewAny(t, ref)
+}
+
+// GetFn implements the get function: (get coll key [default]). It looks up a
+// field of a record, a key of a map or an index of a list, and returns default
+// (or nil) if it is not found.
+func GetFn(coll interface{}, key interface{}, def ...interface{}) interface{} {
+	if len(def) > 1 {
+		panic("Invalid arguments")
+	}
+	if v, ok := lookup(coll, key); ok {
+		return v
+	}
+	if len(def) == 1 {
+		return def[0]
+	}
+	return nil
+}
+
+func lookup(coll interface{}, key interface{}) (interface{}, bool) {
+	if coll == nil {
+		return nil, false
+	}
+	if r, ok := coll.(*Record); ok {
+		name, ok := fieldName(key)
+		if !ok {
+			return nil, false
+		}
+		return r.Get(name)
+	}
+
+	v := reflect.ValueOf(coll)
+	switch v.Kind() {
+	case reflect.Map:
+		if key == nil {
+			if e := v.MapIndex(reflect.Zero(v.Type().Key())); e.IsValid() {
+				return e.Interface(), true
+			}
+			return nil, false
+		}
+		keys := []interface{}{key}
+		if kw, ok := key.(parser.Identifier); ok && IsKeyword(kw) {
+			// Keywords also match the keys with their name.
+			keys = append(keys, string(kw[1:]))
+		}
+		for _, key := range keys {
+			k := reflect.ValueOf(key)
+			if !k.Type().AssignableTo(v.Type().Key()) {
+				if !k.Type().ConvertibleTo(v.Type().Key()) {
+					continue
+				}
+				k = k.Convert(v.Type().Key())
+			}
+			if e := v.MapIndex(k); e.IsValid() {
+				return e.Interface(), true
+			}
+		}
+	case reflect.Slice, reflect.Array, reflect.String:
+		if i, ok := key.(int64); ok {
+			notFound := &struct{}{}
+			if e := Nth(coll, i, notFound); e != notFound {
+				return e, true
+			}
+		}
+	}
+	return nil, false
+}
+
+// Assoc implements the assoc function: (assoc coll key value...). It returns a
+// copy of the record, map or list with the provided keys set.
+func Assoc(coll interface{}, kvs ...interface{}) interface{} {
+	if len(kvs)%2 != 0 {
+		panic("Invalid arguments")
+	}
+
+	if r, ok := coll.(*Record); ok {
+		for i := 0; i < len(kvs); i += 2 {
+			name, ok := fieldName(kvs[i])
+			if !ok {
+				panic(fmt.Sprintf("Invalid field %v in record %s", kvs[i], r.Type.Name))
+			}
+			r = r.Assoc(name, kvs[i+1])
+		}
+		return r
+	}
+
+	v := reflect.ValueOf(coll)
+	switch v.Kind() {
+	case reflect.Map:
+		m := reflect.MakeMapWithSize(v.Type(), v.Len()+len(kvs)/2)
+		iter := v.MapRange()
+		for iter.Next() {
+			m.SetMapIndex(iter.Key(), iter.Value())
+		}
+		for i := 0; i < len(kvs); i += 2 {
+			m.SetMapIndex(assocValue(kvs[i], v.Type().Key()), assocValue(kvs[i+1], v.Type().Elem()))
+		}
+		return m.Interface()
+	case reflect.Slice:
+		s := reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+		reflect.Copy(s, v)
+		for i := 0; i < len(kvs); i += 2 {
+			index, ok := kvs[i].(int64)
+			if !ok || index < 0 || index > int64(s.Len()) {
+				panic(fmt.Sprintf("Invalid index %v", kvs[i]))
+			}
+			var e reflect.Value
+			if _, ok := coll.([]parser.Value); ok {
+				e = reflect.ValueOf(parser.NewAny(kvs[i+1], nil))
+			} else {
+				e = assocValue(kvs[i+1], v.Type().Elem())
+			}
+			if index == int64(s.Len()) {
+				s = reflect.Append(s, e)
+			} else {
+				s.Index(int(index)).Set(e)
+			}
+		}
+		return s.Interface()
+	}
+	panic(fmt.Sprintf("Can not assoc on %T", coll))
+}
+
+// assocValue converts v to a value of type t.
+func assocValue(v interface{}, t reflect.Type) reflect.Value {
+	if v == nil {
+		return reflect.Zero(t)
+	}
+	rv := reflect.ValueOf(v)
+	if !rv.Type().AssignableTo(t) {
+		if !rv.Type().ConvertibleTo(t) {
+			panic(fmt.Sprintf("Invalid value %v, expected %s", v, t))
+		}
+		rv = rv.Convert(t)
+	}
+	return rv
+}
@@ -1,10 +1,15 @@
 package runtime
 
 import (
+	"context"
 	"fmt"
+	"io"
+	"os"
 	"reflect"
 	"runtime"
 	"strings"
+	"sync"
+	"sync/atomic"
 
 	"github.com/rumlang/rum/parser"
 )
@@ -14,6 +19,38 @@ const (
 	ErrPanic = iota
 	// ErrUnknownVariable is raised when trying to resolve an unknown symbol.
 	ErrUnknownVariable
+	// ErrBinding is raised when a value does not match a destructuring
+	// pattern.
+	ErrBinding
+	// ErrArity is raised when a function is called with a wrong number of
+	// arguments.
+	ErrArity
+	// ErrNoMatch is raised when no clause of a match form matches the value.
+	ErrNoMatch
+	// ErrNoMethod is raised when no implementation of a protocol or
+	// multimethod matches the arguments.
+	ErrNoMethod
+	// ErrStepLimit is raised when an evaluation exceeds its number of steps.
+	ErrStepLimit
+	// ErrDepthLimit is raised when an evaluation exceeds its number of nested
+	// calls.
+	ErrDepthLimit
+	// ErrTimeout is raised when an evaluation exceeds its time limit or the
+	// deadline of its context.
+	ErrTimeout
+	// ErrCanceled is raised when the context of an evaluation is canceled.
+	ErrCanceled
+	// ErrMemoryLimit is raised when an evaluation exceeds its memory quota.
+	ErrMemoryLimit
+	// ErrCapability is raised when a script uses a function needing a
+	// capability its context does not have.
+	ErrCapability
+	// ErrRecur is raised when the value of recur is not returned to a loop or
+	// function: recur is not in tail position.
+	ErrRecur
+	// ErrLazySeq is raised when a lazy sequence is realized while it is being
+	// realized.
+	ErrLazySeq
 )
 
 // ErrorCode type to parser errors
@@ -25,6 +62,30 @@ func (c ErrorCode) String() string {
 		return "Panic"
 	case ErrUnknownVariable:
 		return "UnknownVariable"
+	case ErrBinding:
+		return "Binding"
+	case ErrArity:
+		return "Arity"
+	case ErrNoMatch:
+		return "NoMatch"
+	case ErrNoMethod:
+		return "NoMethod"
+	case ErrStepLimit:
+		return "StepLimit"
+	case ErrDepthLimit:
+		return "DepthLimit"
+	case ErrTimeout:
+		return "Timeout"
+	case ErrCanceled:
+		return "Canceled"
+	case ErrMemoryLimit:
+		return "MemoryLimit"
+	case ErrCapability:
+		return "CapabilityDenied"
+	case ErrRecur:
+		return "Recur"
+	case ErrLazySeq:
+		return "LazySeq"
 	default:
 		return fmt.Sprintf("Unknown[%d]", c)
 	}
@@ -39,7 +100,9 @@ type Error struct {
 	Stack []parser.Value
 
 	PanicRecovered interface{}
-	PanicStack     []byte
+	// PanicStack is the Go stack where the panic was recovered, only collected
+	// in debug mode.
+	PanicStack []byte
 }
 
 func (e *Error) String() string {
@@ -56,7 +119,7 @@ func (e *Error) String() string {
 		msg = &calledFrom
 	}
 
-	if e.Code == ErrPanic {
+	if e.Code == ErrPanic && len(e.PanicStack) > 0 {
 		out += "  # Interpreter trace:\n"
 		for _, line := range strings.Split(string(e.PanicStack), "\n") {
 			out += fmt.Sprintf("    %s\n", line)
@@ -76,35 +139,146 @@ type Internal func(*Context, ...parser.Value) parser.Value
 // Context contains details about the current execution frame.
 type Context struct {
 	parent       *Context
-	env          map[parser.Identifier]parser.Value
+	top          *Context
+	env          map[parser.Symbol]parser.Value
 	typeRegistry map[string]reflect.Type
+	// matches caches the compiled match forms. Only used on the root context.
+	matches matchCache
+	// redefinable allows let to replace an existing binding, with a warning.
+	// Only used on the root context.
+	redefinable bool
+	// immutable forbids replacing or changing any binding. Only used on the
+	// root context.
+	immutable bool
+	// debug enables the collection of the Go stack of panics. Only used on the
+	// root context.
+	debug bool
+	// limits restricts the evaluations and running contains the state of the
+	// running ones, if any. Only used on the root context.
+	limits  Limits
+	mu      sync.Mutex
+	running atomic.Value
+	// capabilities are the permissions of the scripts, and roots the
+	// directories where they can access files. Only used on the root context.
+	capabilities Capability
+	roots        []string
+	// bound is the memory charged for the bindings of the context to the
+	// running evaluation, released when its scope ends.
+	bound int64
+	// stdout, stderr and stdin are the streams of the context; nil to inherit
+	// the ones of the parent.
+	stdout io.Writer
+	stderr io.Writer
+	stdin  io.Reader
+}
+
+// SetDebug sets whether the Go stack is collected when recovering from a
+// panic, to be printed with the error. It is disabled by default as it is
+// expensive.
+func (c *Context) SetDebug(debug bool) {
+	c.root().debug = debug
+}
+
+// AllowRedefinition sets whether def and let can replace an existing binding
+// of the same scope. A warning is then printed for each redefinition. This is
+// meant for interactive sessions, where definitions are often reloaded.
+func (c *Context) AllowRedefinition(allow bool) {
+	c.root().redefinable = allow
+}
+
+// SetImmutable sets whether bindings can be replaced or changed once defined.
+// When immutable, def panics on an existing name like let does and set! is
+// not allowed.
+func (c *Context) SetImmutable(immutable bool) {
+	c.root().immutable = immutable
+}
+
+// root returns the top-level context.
+func (c *Context) root() *Context {
+	return c.top
 }
 
 // Get returns the content of the specified variable. It will automatically
 // look up parent context if needed. Generate a panic with an Error object if
 // the specified variable does not exists.
 func (c *Context) Get(id parser.Identifier) parser.Value {
-	v, ok := c.env[id]
+	return c.get(id.Symbol())
+}
+
+// get is Get with the symbol of the variable.
+func (c *Context) get(sym parser.Symbol) parser.Value {
+	v, ok := c.lookup(sym)
 	if !ok {
-		if c.parent != nil {
-			return c.parent.Get(id)
-		}
 		panic(&Error{
 			Code: ErrUnknownVariable,
-			Msg:  fmt.Sprintf("%q does not exist", string(id)),
+			Msg:  fmt.Sprintf("%q does not exist", sym.Name()),
 		})
 	}
 	return v
 }
 
+// lookup returns the content of the specified variable, looking up parent
+// contexts if needed, and whether it exists.
+func (c *Context) lookup(sym parser.Symbol) (parser.Value, bool) {
+	for ; c != nil; c = c.parent {
+		if v, ok := c.env[sym]; ok {
+			return v, true
+		}
+	}
+	return nil, false
+}
+
 // Set an iten in parser function map
 func (c *Context) Set(id parser.Identifier, v parser.Value) parser.Value {
+	return c.define(id.Symbol(), v, true)
+}
+
+// define binds id to v in the current scope. If id is already defined in that
+// scope, it is replaced with a warning when redefinitions are allowed. Else,
+// strict definitions panic while the others silently replace the value, unless
+// the context is immutable.
+func (c *Context) define(id parser.Symbol, v parser.Value, strict bool) parser.Value {
 	_, ok := c.env[id]
+	if ok {
+		root := c.root()
+		switch {
+		case root.immutable:
+			panic(fmt.Sprintf("Variable called %s just has a value in that scope", id))
+		case root.redefinable:
+			var ref *parser.SourceRef
+			if v != nil {
+				ref = v.Ref()
+			}
+			c.warn(ref, "redefining %s", id)
+		case strict:
+			panic(fmt.Sprintf("Variable called %s just has a value in that scope", id))
+		}
+	}
+	c.env[id] = v
 	if !ok {
-		c.env[id] = v
-		return v
+		c.bind()
 	}
-	panic(fmt.Sprintf("Variable called %s just has a value in that scope", id))
+	return v
+}
+
+// Update changes the value of an existing variable, in the scope where it is
+// defined. Generate a panic with an Error object if the specified variable
+// does not exists.
+func (c *Context) Update(id parser.Identifier, v parser.Value) parser.Value {
+	if c.root().immutable {
+		panic(fmt.Sprintf("Variable called %s can not be changed in an immutable context", id))
+	}
+	sym := id.Symbol()
+	for s := c; s != nil; s = s.parent {
+		if _, ok := s.env[sym]; ok {
+			s.env[sym] = v
+			return v
+		}
+	}
+	panic(&Error{
+		Code: ErrUnknownVariable,
+		Msg:  fmt.Sprintf("%q does not exist", string(id)),
+	})
 }
 
 // SetFn an function in parser function map
@@ -128,7 +302,7 @@ func (c *Context) SetFn(id parser.Identifier, v interface{}, adapters ...Adapter
 		return result[0].Interface()
 	}
 
-	c.env[id] = parser.NewAny(f, nil)
+	c.env[id.Symbol()] = parser.NewAny(f, nil)
 }
 
 //RegisterType register an new type in runtime. A nil or zero typed value must be the parameter
@@ -137,6 +311,26 @@ func (c *Context) RegisterType(typedNil interface{}) {
 	c.typeRegistry[t.PkgPath()+"."+t.Name()] = t
 }
 
+// LookupType returns the type registered with RegisterType under the provided
+// name, looking up parent contexts if needed.
+func (c *Context) LookupType(name string) (reflect.Type, bool) {
+	for ctx := c; ctx != nil; ctx = ctx.parent {
+		if t, ok := ctx.typeRegistry[name]; ok {
+			return t, true
+		}
+	}
+	return nil, false
+}
+
+// warn reports a non fatal problem found in the evaluated code.
+func (c *Context) warn(ref *parser.SourceRef, format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	if ref != nil {
+		msg = fmt.Sprintf("line %d, col %d: %s", ref.Line+1, ref.Column+1, msg)
+	}
+	fmt.Fprintf(c.Stderr(), "warning: %s\n", msg)
+}
+
 // dispatch takes the provided value, evaluates it based on the current content
 // of the context and returns the result. All errors are sent through panics.
 func (c *Context) dispatch(input parser.Value) (parser.Value, error) {
@@ -155,87 +349,224 @@ func (c *Context) dispatch(input parser.Value) (parser.Value, error) {
 			return internal(c, data[1:]...), nil
 		}
 
-		var args []reflect.Value
+		var args []parser.Value
 		for _, child := range data[1:] {
 			v, err := c.eval(child)
 			if err != nil {
 				return nil, err
 			}
-			data := v.Value()
-
-			if data == nil {
-				// Do a ValueOf of the pointer to get the element afterward - that
-				// circumvent the special value with nil which is otherwise translated to
-				// an invalid element.
-				args = append(args, reflect.ValueOf(&data).Elem())
-				continue
-			}
-			args = append(args, reflect.ValueOf(data))
-
-		}
-		result := reflect.ValueOf(fn.Value()).Call(args)
-		if len(result) == 0 {
-			return parser.NewAny(nil, nil), nil
+			args = append(args, v)
 		}
-		if len(result) == 1 {
-			return parser.NewAny(result[0].Interface(), nil), nil
+		result := call(fn, args, input.Ref())
+		if _, ok := fn.Value().(callable); !ok {
+			// Rum functions and accounted builtins account for their own
+			// allocations.
+			c.root().current().allocValue(result)
 		}
-		panic("Multiple arguments unsupported")
+		return result, nil
 	case parser.Identifier:
-		return c.Get(data), nil
+		if IsKeyword(data) {
+			return input, nil
+		}
+		sym, _ := parser.SymbolOf(input)
+		return c.get(sym), nil
 	default:
 		// If it is neither an identifier or a list, just return the value.
 		return input, nil
 	}
 }
 
-// eval evaluates the provided value. It makes sure to catch any panic and
-// create an error (type *Error) with full stack trace when that happens.
+// callable is implemented by the values, other than Go functions, which can
+// be called from Rum code.
+type callable interface {
+	call(args []parser.Value, ref *parser.SourceRef) parser.Value
+}
+
+// call invokes fn with already evaluated arguments. fn can either be a Rum
+// function, a callable or any Go function. ref is the source of the call, used
+// when reporting errors.
+func call(fn parser.Value, args []parser.Value, ref *parser.SourceRef) parser.Value {
+	for _, arg := range args {
+		notRecur(arg)
+	}
+	if f, ok := fn.Value().(callable); ok {
+		return f.call(args, ref)
+	}
+
+	var vargs []reflect.Value
+	for _, arg := range args {
+		data := arg.Value()
+		if data == nil {
+			// Do a ValueOf of the pointer to get the element afterward - that
+			// circumvent the special value with nil which is otherwise translated to
+			// an invalid element.
+			vargs = append(vargs, reflect.ValueOf(&data).Elem())
+			continue
+		}
+		vargs = append(vargs, reflect.ValueOf(data))
+	}
+	result := reflect.ValueOf(fn.Value()).Call(vargs)
+	if len(result) == 0 {
+		return parser.NewAny(nil, nil)
+	}
+	if len(result) == 1 {
+		return parser.NewAny(result[0].Interface(), nil)
+	}
+	panic("Multiple arguments unsupported")
+}
+
+// tailCall is returned by special forms and functions for the expression in
+// tail position, instead of evaluating it themselves. eval then continues
+// with that expression, so tail calls don't grow the Go stack.
+type tailCall struct {
+	ctx  *Context
+	expr parser.Value
+}
+
+// tail returns a value asking eval to continue with expr in the context c.
+func (c *Context) tail(expr parser.Value) parser.Value {
+	return parser.NewAny(&tailCall{ctx: c, expr: expr}, nil)
+}
+
+// resolve fully evaluates v if it is a tail call. The value of a recur is an
+// error, as it can only be returned to a loop or function.
+func resolve(v parser.Value) parser.Value {
+	if tc, ok := v.Value().(*tailCall); ok {
+		defer tc.ctx.release()
+		return tc.ctx.MustEval(tc.expr)
+	}
+	return notRecur(v)
+}
+
+// eval evaluates the provided value, looping over the tail calls returned by
+// special forms and functions.
 func (c *Context) eval(input parser.Value) (parser.Value, error) {
-	var recov interface{}
-	var result parser.Value
-	var stack []byte
-	var err error
-	func() {
-		defer func() {
-			const size = 16384
-			stack = make([]byte, size)
-			// Unfortunately, that also catch itself, adding noise to the trace.
-			stack = stack[:runtime.Stack(stack, false)]
-			recov = recover()
-		}()
-		result, err = c.dispatch(input)
+	ev := c.root().current()
+	if err := ev.enter(); err != nil {
+		err.Stack = append(err.Stack, input)
+		return nil, err
+	}
+	defer ev.leave()
+
+	// The scopes entered by tail calls end with the evaluation, or as soon
+	// as it continues outside of them.
+	start, scopes := c, []*Context(nil)
+	defer func() {
+		for _, s := range scopes {
+			s.release()
+		}
 	}()
 
-	if recov != nil {
-		err = &Error{
-			Code:           ErrPanic,
-			Msg:            fmt.Sprintf("%v", recov),
-			PanicRecovered: recov,
-			PanicStack:     stack,
+	for {
+		if err := ev.step(); err != nil {
+			err.Stack = append(err.Stack, input)
+			return nil, err
+		}
+		result, err := c.step(input)
+		if err != nil {
+			return nil, err
+		}
+		tc, ok := result.Value().(*tailCall)
+		if !ok {
+			return result, nil
+		}
+		c, input = tc.ctx, tc.expr
+		if ev != nil && ev.limits.Memory > 0 {
+			scopes = enterScope(scopes, start, c)
+		}
+	}
+}
+
+// enterScope returns the scopes entered by the tail calls of an evaluation
+// which started in start, once it continues in next: the scopes which do not
+// enclose next are released, and next and the scopes enclosing it are added
+// unless they enclose start.
+func enterScope(scopes []*Context, start, next *Context) []*Context {
+	kept := scopes[:0]
+	for _, s := range scopes {
+		if s.encloses(next) {
+			kept = append(kept, s)
+		} else {
+			s.release()
 		}
-		if details, ok := recov.(*Error); ok {
-			err = details
+	}
+	n := len(kept)
+next:
+	for d := next; d != nil && !d.encloses(start); d = d.parent {
+		for _, s := range kept[:n] {
+			if s == d {
+				break next
+			}
 		}
+		kept = append(kept, d)
 	}
+	return kept
+}
 
-	if err != nil {
-		err.(*Error).Stack = append(err.(*Error).Stack, input)
+// encloses reports whether d is c or one of its nested contexts.
+func (c *Context) encloses(d *Context) bool {
+	for ; d != nil; d = d.parent {
+		if d == c {
+			return true
+		}
 	}
+	return false
+}
+
+// step evaluates the provided value - which might result in a tail call. It
+// makes sure to catch any panic and create an error (type *Error) with full
+// stack trace when that happens.
+func (c *Context) step(input parser.Value) (result parser.Value, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = c.recovered(r)
+		}
+		if err != nil {
+			err.(*Error).Stack = append(err.(*Error).Stack, input)
+		}
+	}()
+	return c.dispatch(input)
+}
 
-	return result, err
+// recovered converts a value recovered from a panic to an *Error. The Go stack
+// is only collected in debug mode.
+func (c *Context) recovered(r interface{}) *Error {
+	if err, ok := r.(*Error); ok {
+		return err
+	}
+	err := &Error{
+		Code:           ErrPanic,
+		Msg:            fmt.Sprintf("%v", r),
+		PanicRecovered: r,
+	}
+	if c.root().debug {
+		const size = 16384
+		stack := make([]byte, size)
+		err.PanicStack = stack[:runtime.Stack(stack, false)]
+	}
+	return err
 }
 
 // TryEval evaluates the provided value and catch any panic, return an error
 // instead.
 func (c *Context) TryEval(input parser.Value) (parser.Value, error) {
-	return c.eval(input)
+	return c.TryEvalContext(context.Background(), input)
 }
 
 // MustEval evaluates the provided value, generatic panics when something bad
 // happens. Panics will be *Error instances, containing the call stack.
 func (c *Context) MustEval(input parser.Value) parser.Value {
-	v, err := c.eval(input)
+	return notRecur(c.evalRecur(input))
+}
+
+// evalRecur is similar to MustEval, but the value can be the one of a recur,
+// for the loops and functions evaluating the last expression of their body.
+func (c *Context) evalRecur(input parser.Value) parser.Value {
+	eval := c.eval
+	if c.root().current() == nil {
+		eval = c.TryEval
+	}
+	v, err := eval(input)
 	if err != nil {
 		panic(err)
 	}
@@ -247,48 +578,121 @@ func (c *Context) MustEval(input parser.Value) parser.Value {
 func NewContext(parent *Context) *Context {
 	c := &Context{
 		parent:       parent,
-		env:          make(map[parser.Identifier]parser.Value),
+		env:          make(map[parser.Symbol]parser.Value),
 		typeRegistry: make(map[string]reflect.Type),
 	}
+	c.top = c
+	if parent != nil {
+		c.top = parent.top
+	}
 
 	if parent == nil {
+		c.capabilities = CapDefault
 		defaults := map[parser.Identifier]interface{}{
-			"package": Package,
-			"array":   Internal(Array),
-			"let":     Internal(Let),
-			"if":      Internal(If),
-			"def":     Internal(Def),
-			"lambda":  Internal(Lambda),
-			"eval":    Internal(Eval),
-			"for":     Internal(For),
-			"coerce":  Internal(Coerce),
-			".":       Internal(Invoke),
-			"import":  Internal(Import),
-			"panic":   Panic,
-			"len":     Length,
-			"print":   Print,
-			"println": Println,
-			"sprintf": Sprintf,
-			"fprintf": fmt.Fprintf,
-			"type":    Type,
-			"nil":     nil,
-			"true":    true,
-			"false":   false,
-			"+":       OpAdd,
-			"-":       OpSub,
-			"*":       OpMul,
-			"**":      OpPow,
-			"==":      OpEqual,
-			"!=":      OpNotEqual,
-			"<":       OpLess,
-			"<=":      OpLessEqual,
-			">":       OpGreater,
-			">=":      OpGreaterEqual,
+			"package":          Package,
+			"array":            Internal(Array),
+			"let":              Internal(Let),
+			"set!":             Internal(SetBang),
+			"if":               Internal(If),
+			"and":              Internal(And),
+			"or":               Internal(Or),
+			"not":              Not,
+			"cond":             Internal(Cond),
+			"case":             Internal(Case),
+			"when":             Internal(When),
+			"unless":           Internal(Unless),
+			"match":            Internal(Match),
+			"do":               Internal(Do),
+			"begin":            Internal(Do),
+			"let*":             Internal(LetStar),
+			"loop":             Internal(Loop),
+			"recur":            Internal(Recur),
+			"letrec":           Internal(LetRec),
+			"def":              Internal(Def),
+			"lambda":           Internal(Lambda),
+			"eval":             Internal(Eval),
+			"for":              Internal(For),
+			"for-each":         Internal(ForEach),
+			"doseq":            Internal(ForEach),
+			"coerce":           Internal(Coerce),
+			".":                Internal(Invoke),
+			"defrecord":        Internal(DefRecord),
+			"defstruct":        Internal(DefRecord),
+			"get":              GetFn,
+			"defprotocol":      Internal(DefProtocol),
+			"extend-type":      Internal(ExtendType),
+			"satisfies?":       Satisfies,
+			"defmulti":         Internal(DefMulti),
+			"defmethod":        Internal(DefMethod),
+			"assoc":            Assoc,
+			"import":           Internal(Import),
+			"panic":            Panic,
+			"len":              Length,
+			"list":             List,
+			"map":              Map,
+			"filter":           Filter,
+			"reduce":           Reduce,
+			"drop":             Drop,
+			"reverse":          Reverse,
+			"sort":             Sort,
+			"sort-by":          SortBy,
+			"group-by":         GroupBy,
+			"frequencies":      Frequencies,
+			"zip":              Zip,
+			"first":            First,
+			"rest":             Rest,
+			"cons":             Cons,
+			"nth":              Nth,
+			"some":             Some,
+			"every?":           Every,
+			"lazy-seq":         Internal(LazySeqForm),
+			"seq":              Seq,
+			"iterate":          IterateSeq,
+			"repeat":           Repeat,
+			"cycle":            Cycle,
+			"take-while":       TakeWhile,
+			"atom":             AtomFn,
+			"deref":            Deref,
+			"reset!":           ResetAtom,
+			"swap!":            SwapAtom,
+			"compare-and-set!": CompareAndSetAtom,
+			"set-validator!":   SetValidator,
+			"add-watch":        AddWatch,
+			"remove-watch":     RemoveWatch,
+			"sprintf":          Sprintf,
+			"fprintf":          Fprintf,
+			"pr-str":           PrStr,
+			"str":              Str,
+			"type":             Type,
+			"nil":              nil,
+			"true":             true,
+			"false":            false,
+			"+":                OpAdd,
+			"-":                OpSub,
+			"*":                OpMul,
+			"**":               OpPow,
+			"==":               OpEqual,
+			"!=":               OpNotEqual,
+			"<":                OpLess,
+			"<=":               OpLessEqual,
+			">":                OpGreater,
+			">=":               OpGreaterEqual,
 		}
 
 		for name, value := range defaults {
-			c.env[name] = parser.NewAny(value, nil)
+			c.env[name.Symbol()] = parser.NewAny(value, nil)
+		}
+		// The builtins building lists of any size charge the memory quota
+		// before building them.
+		accounted := map[parser.Identifier]interface{}{
+			"range":  rangeValues,
+			"take":   takeValues,
+			"concat": concatValues,
+		}
+		for name, fn := range accounted {
+			c.env[name.Symbol()] = parser.NewAny(c.accounted(fn), nil)
 		}
+		c.bindIO()
 	}
 
 	return c
@@ -299,6 +703,7 @@ func Array(ctx *Context, args ...parser.Value) parser.Value {
 	if len(args) != 1 {
 		panic("Invalid number of arguments for array")
 	}
+	ctx.root().current().allocValue(args[0])
 	return args[0]
 }
 
@@ -310,7 +715,9 @@ func Package(name string, values ...interface{}) interface{} {
 	return values[len(values)-1]
 }
 
-// Import implements the import package feature.
+// Import implements the import package feature: (import pkg...) defines the
+// functions of each package as pkg.name, and (import (alias "pkg")) as
+// alias.name.
 func Import(ctx *Context, args ...parser.Value) (v parser.Value) {
 	if len(args) == 0 {
 		panic("Invalid arguments")
@@ -333,48 +740,64 @@ func Import(ctx *Context, args ...parser.Value) (v parser.Value) {
 		default:
 			panic(fmt.Sprintf("package %s not found", Type(args[key].Value())))
 		}
+		// Only the functions are bound, with the prefix: the alias itself is not,
+		// so that it can be the name of a builtin (e.g., str).
 		loadStdLib(packageNameStr, ctx, packageID)
-		v = ctx.Set(packageID, packageName)
+		v = packageName
 	}
 	return v
 }
 
-// Let implements the let reserved word.
+// Let implements the let reserved word. (let name value) defines name in the
+// current context, while (let ((name value)...) body...) only binds the names
+// for the evaluation of body.
 func Let(ctx *Context, args ...parser.Value) parser.Value {
+	if len(args) < 1 {
+		panic("Invalid arguments")
+	}
+
+	if _, ok := args[0].Value().([]parser.Value); ok {
+		return LetScoped(ctx, args...)
+	}
+
 	if len(args) != 2 {
 		panic("Invalid arguments")
 	}
 
-	id, ok := args[0].Value().(parser.Identifier)
+	sym, ok := parser.SymbolOf(args[0])
 	if !ok {
 		panic("TODO")
 	}
-	return ctx.Set(id, ctx.MustEval(args[1]))
+	return ctx.define(sym, ctx.MustEval(args[1]), true)
 }
 
 // If implements the 'if' builtin function. It has to be an Internal interface
 // - otherwise, both true & false expressions would have been already
-// evaluated.
+// evaluated. The condition follows the Truthy rule.
+// Each branch is a single expression: do groups several.
 func If(ctx *Context, args ...parser.Value) parser.Value {
-	if len(args) < 2 || len(args) > 3 {
+	if len(args) < 2 {
 		panic("Invalid arguments")
 	}
-
-	cond := ctx.MustEval(args[0]).Value().(bool)
-	if cond {
-		return ctx.MustEval(args[1])
+	if len(args) > 3 {
+		panic(&Error{
+			Code: ErrArity,
+			Msg:  fmt.Sprintf("if expects a test, a then and an optional else expression, got %d expressions: use do to group several", len(args)),
+		})
 	}
 
-	if len(args) <= 2 {
-		return parser.NewAny(nil, nil)
+	if Truthy(ctx.MustEval(args[0]).Value()) {
+		return ctx.tail(args[1])
 	}
 
-	return ctx.MustEval(args[2])
+	return tailBody(ctx, args[2:])
 }
 
-// Def is a group of statements that together perform a task.
+// Def is a group of statements that together perform a task:
+// (def name (params...) body...) or, with multiple arities,
+// (def name ((params...) body...)...).
 func Def(ctx *Context, args ...parser.Value) parser.Value {
-	if len(args) != 3 {
+	if len(args) < 2 {
 		panic("Invalid arguments")
 	}
 
@@ -383,95 +806,56 @@ func Def(ctx *Context, args ...parser.Value) parser.Value {
 		panic("TODO")
 	}
 
-	params, ok := args[1].Value().([]parser.Value)
-	if !ok {
-		panic("TODO")
-	}
-	names := []parser.Identifier{}
-	for _, v := range params {
-		nameid, ok := v.Value().(parser.Identifier)
-		if !ok {
-			panic("TODO")
-		}
-		names = append(names, nameid)
-	}
-	implValue := args[2]
-	impl := func(implCtx *Context, args ...parser.Value) parser.Value {
-		if len(args) != len(names) {
-			panic("TODO")
-		}
-		nested := NewContext(implCtx)
-		for i, name := range names {
-			nested.Set(name, implCtx.MustEval(args[i]))
-		}
-		return nested.MustEval(implValue)
-	}
-	ctx.env[id] = parser.NewAny(Internal(impl), nil)
-	return ctx.env[id]
+	sym, _ := parser.SymbolOf(args[0])
+	return ctx.define(sym, parser.NewAny(NewFunction(ctx, string(id), args[1:]), args[0].Ref()), false)
 }
 
-// Lambda anonymous functions that are evaluated only when they are encountered in the program
-func Lambda(ctx *Context, args ...parser.Value) parser.Value {
+// SetBang implements the set! builtin function: (set! name value). It changes
+// the value of an existing variable in the scope where it is defined.
+func SetBang(ctx *Context, args ...parser.Value) parser.Value {
 	if len(args) != 2 {
 		panic("Invalid arguments")
 	}
 
-	params, ok := args[0].Value().([]parser.Value)
+	id, ok := args[0].Value().(parser.Identifier)
 	if !ok {
-		panic("TODO")
-	}
-	names := []parser.Identifier{}
-	for _, v := range params {
-		id, ok := v.Value().(parser.Identifier)
-		if !ok {
-			panic("TODO")
-		}
-		names = append(names, id)
+		panic("Invalid arguments")
 	}
-	implValue := args[1]
-	impl := func(implCtx *Context, args ...parser.Value) parser.Value {
-		if len(args) != len(names) {
-			panic("TODO")
-		}
-		nested := NewContext(implCtx)
-		for i, name := range names {
-			nested.Set(name, implCtx.MustEval(args[i]))
-		}
-		return nested.MustEval(implValue)
+	return ctx.Update(id, ctx.MustEval(args[1]))
+}
+
+// Lambda anonymous functions that are evaluated only when they are encountered in the program
+func Lambda(ctx *Context, args ...parser.Value) parser.Value {
+	if len(args) < 1 {
+		panic("Invalid arguments")
 	}
 
-	return parser.NewAny(Internal(impl), nil)
+	return parser.NewAny(NewFunction(ctx, "", args), nil)
 }
 
 // Type implements the type function.
 func Type(v interface{}) string {
+	if r, ok := v.(*Record); ok {
+		return r.Type.Name
+	}
 	return fmt.Sprintf("%T", v)
 }
 
-// Length implements the len function.
-func Length(elt []parser.Value) int64 {
-	return int64(len(elt))
-}
-
 // Panic implements the panic function.
 func Panic(v interface{}) {
 	panic(v)
 }
 
-// Print implements the print function.
+// Print writes the display representation of args to the standard output,
+// like the print function of a context which has not redirected it.
 func Print(args ...interface{}) {
-	for i, v := range args {
-		if i != 0 {
-			fmt.Print(" ")
-		}
-		fmt.Printf("%v", v)
-	}
+	fprint(os.Stdout, args...)
 }
 
-// Println implements the print function.
+// Println is similar to Print, followed by a newline.
 func Println(args ...interface{}) {
-	Print(args)
-	fmt.Printf("\n")
+	Print(args...)
+	fmt.Println()
 }
 
 // Sprintf implements the sprintf function.
@@ -498,40 +882,10 @@ func Eval(ctx *Context, raw ...parser.Value) parser.Value {
 	return result
 }
 
-// For implements for loop
-func For(ctx *Context, args ...parser.Value) parser.Value {
-	if len(args) < 2 {
-		panic("Invalid arguments")
-	}
-	_, ok := args[0].Value().(parser.Identifier)
-	if !ok {
-		panic("TODO")
-	}
-	params, ok := args[1].Value().([]parser.Value)
-	if !ok {
-		panic("TODO")
-	}
-	for _, s := range params[1:] {
-		vs, ok := s.Value().([]parser.Value)
-		if !ok {
-			panic("TODO")
-		}
-		for _, v := range vs {
-			input := parser.NewAny([]parser.Value{args[0], v}, nil)
-			_, err := ctx.dispatch(input)
-			if err != nil {
-				err.(*Error).Stack = append(err.(*Error).Stack, input)
-				return parser.NewAny(nil, nil)
-			}
-		}
-	}
-	return parser.NewAny(nil, nil)
-}
-
 //Dump the context content
 func (c *Context) Dump() {
 	for id, val := range c.env {
-		fmt.Println(id, val)
+		fmt.Fprintln(c.Stdout(), id, val)
 	}
 }
 
@@ -542,6 +896,11 @@ func Invoke(ctx *Context, args ...parser.Value) parser.Value {
 	}
 
 	obj := ctx.MustEval(args[0]).Value()
+	if r, ok := obj.(*Record); ok && len(args) == 2 {
+		if v, ok := r.Get(args[1].String()); ok {
+			return parser.NewAny(v, nil)
+		}
+	}
 	descriptor := MethodNameTransform(args[1].String())
 
 	method := reflect.ValueOf(obj).MethodByName(descriptor)
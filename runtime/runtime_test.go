@@ -2,12 +2,14 @@ package runtime
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io/ioutil"
 	"math"
 	"math/rand"
 	"net/http"
 	"reflect"
+	"runtime/debug"
 	"strings"
 	"testing"
 	"time"
@@ -27,6 +29,20 @@ func mustEval(s string) parser.Value {
 	return NewContext(nil).MustEval(mustParse(s))
 }
 
+// unwrap replaces recursively the Rum lists by []interface{}, to ease
+// comparisons.
+func unwrap(v interface{}) interface{} {
+	list, ok := v.([]parser.Value)
+	if !ok {
+		return v
+	}
+	values := []interface{}{}
+	for _, elt := range list {
+		values = append(values, unwrap(elt.Value()))
+	}
+	return values
+}
+
 //RunSExpressions execute in sequence the sexprs in exprs param using the Context c
 func RunSExpressions(c *Context, exprs []string, t *testing.T) {
 	for _, expr := range exprs {
@@ -101,12 +117,64 @@ func TestValid(t *testing.T) {
 		"(if true 7)":    int64(7),
 		"(if false 7)":   nil,
 		"(if false 7 8)": int64(8),
+		"(if nil 7 8)":   int64(8),
+		"(if 0 7 8)":     int64(7),
+		`(if "" 7 8)`:    int64(7),
+		// Test boolean logic
+		"(and)":                 true,
+		"(and 1 2)":             int64(2),
+		"(and 1 nil 2)":         nil,
+		"(and false (panic 1))": false,
+		"(or)":                  nil,
+		"(or nil false 3)":      int64(3),
+		"(or 1 (panic 1))":      int64(1),
+		"(or nil false)":        false,
+		"(not nil)":             true,
+		"(not 0)":               false,
+		"(not (== 1 2))":        true,
+		// Test 'cond' and 'case'
+		"(cond ((== 1 2) 1) ((== 1 1) 2) (else 3))": int64(2),
+		"(cond ((== 1 2) 1) (else 3))":              int64(3),
+		"(cond ((== 1 2) 1))":                       nil,
+		"(cond ((+ 1 2)))":                          int64(3),
+		"(cond (true 1 2))":                         int64(2),
+		`(case (+ 1 2) (1 "one") ((2 3) "two or three") (else "other"))`: "two or three",
+		`(case "b" ("a" 1) ("b" 2))`:                                     int64(2),
+		`(case 3.0 (3 "three"))`:                                         "three",
+		`(case 4 (1 "one") (else "other"))`:                              "other",
+		`(case 4 (1 "one"))`:                                             nil,
+		// Test 'when' and 'unless'
+		"(when true 1 2)":  int64(2),
+		"(when nil 1 2)":   nil,
+		"(unless nil 1 2)": int64(2),
+		"(unless 0 1 2)":   nil,
+		// Test 'do'
+		"(do)":                  nil,
+		"(do 1 2 3)":            int64(3),
+		"(begin (+ 1 2))":       int64(3),
+		"(if false 1 (do 2 3))": int64(3),
+		// Test scoped 'let', 'let*' and 'letrec'
+		"(let ((a 1) (b 2)) (+ a b))":                                         int64(3),
+		"(let ((a 1)) 5 a)":                                                   int64(1),
+		`(package "main" (let a 1) (let ((a 2)) a))`:                          int64(2),
+		`(package "main" (let a 1) (let ((a 2) (b a)) b))`:                    int64(1),
+		`(package "main" (let ((a 2)) a) (let a 1) a)`:                        int64(1),
+		"(let* ((a 1) (b (+ a 1))) b)":                                        int64(2),
+		"(let* ((a 1) (a (+ a 1))) a)":                                        int64(2),
+		"(letrec ((f (lambda (n) (if (== n 0) 0 (+ n (f (- n 1))))))) (f 4))": int64(10),
+		"((let ((x 3)) (lambda (y) (+ x y))) 4)":                              int64(7),
 		// Test 'lambda'
 		`(package "main" (let d (lambda (n) (+ n n))) (d 3))`: int64(6),
 		// Test 'def'
-		`(package "main" (def d(n) (+ n n)) (d 3))`: int64(6),
+		`(package "main" (def d(n) (+ n n)) (d 3))`:             int64(6),
+		`(package "main" (def d(n) (let x 1) (+ n x)) (d 3))`:   int64(4),
+		`(package "main" (let d (lambda (n) 1 (* n n))) (d 3))`: int64(9),
 		// Test that inner scopes are not override outer scope.
 		`(package "main" (let n 7) (let d (lambda (n) (+ n n))) (+ n (d 3)))`: int64(13),
+		// Test that functions see the variables where they are defined, not the
+		// ones of their caller.
+		`(package "main" (let x 1) (def f () x) (def g (x) (f)) (g 2))`:                   int64(1),
+		`(package "main" (def adder (n) (lambda (x) (+ x n))) (let n 100) ((adder 1) 2))`: int64(3),
 		// Test float
 		".3": float64(.3),
 		// Test length
@@ -119,7 +187,7 @@ func TestValid(t *testing.T) {
 		// Test empty
 		`()`: nil,
 		// Test for
-		`(for print (array (10 20 30)))`: nil,
+		`(for-each (x (array (10 20 30))) (print x))`: nil,
 		// Test sprintf
 		`(sprintf "%02d %02d" 1 2)`:                               "01 02",
 		`(sprintf "%02X" 255)`:                                    "FF",
@@ -139,6 +207,12 @@ func TestValid(t *testing.T) {
 			t.Errorf("Input %q -- expected <%T>%#+v, got: <%T>%#+v", input, expected, expected, r, r)
 		}
 	}
+
+	// The branches of if are single expressions.
+	_, err := NewContext(nil).TryEval(mustParse("(if false 1 2 3)"))
+	if e, ok := err.(*Error); !ok || e.Code != ErrArity || !strings.Contains(e.Msg, "use do") {
+		t.Errorf("Expected an arity error for the extra expressions of if, got: %v", err)
+	}
 }
 
 func TestValidList(t *testing.T) {
@@ -191,6 +265,24 @@ func TestPanic(t *testing.T) {
 	}
 }
 
+func TestPanicStack(t *testing.T) {
+	for _, debug := range []bool{false, true} {
+		c := NewContext(nil)
+		c.SetDebug(debug)
+		_, err := c.TryEval(mustParse("(+ 1 (2))"))
+		if err == nil {
+			t.Fatalf("Expected an error")
+		}
+		e := err.(*Error)
+		if (len(e.PanicStack) > 0) != debug {
+			t.Errorf("Debug %v - unexpected Go stack: %q", debug, e.PanicStack)
+		}
+		if len(e.Stack) != 2 {
+			t.Errorf("Debug %v - expected 2 frames, got: %v", debug, e.Stack)
+		}
+	}
+}
+
 func TestUnknownVariable(t *testing.T) {
 	s := "(a)"
 
@@ -219,6 +311,13 @@ func TestUnknownVariable(t *testing.T) {
 	if err == nil {
 		t.Fatalf("%q should have generated an error.", s)
 	}
+
+	// The variables of the caller are not visible from the called function.
+	s = `(package "main" (def f () y) (def g (y) (f)) (g 2))`
+	_, err = NewContext(nil).TryEval(mustParse(s))
+	if e, ok := err.(*Error); !ok || e.Code != ErrUnknownVariable {
+		t.Errorf("%q - expected an UnknownVariable, got: %v", s, err)
+	}
 }
 
 func TestGoFunction(t *testing.T) {
@@ -324,3 +423,1233 @@ func TestCoerce(t *testing.T) {
 	RunSExpressions(c, exprs, t)
 }
 */
+
+func TestDestructuring(t *testing.T) {
+	valid := map[string]interface{}{
+		"(let (((a b) (array (1 2)))) (+ a b))":                            int64(3),
+		"(let (((a & rest) (array (1 2 3)))) (len rest))":                  int64(2),
+		"(let (((a & _) (array (1 2 3)))) a)":                              int64(1),
+		"(let (((a _ c) (array (1 2 3)))) c)":                              int64(3),
+		"(let (((a (b c)) (array (1 (2 3))))) c)":                          int64(3),
+		"(let (((a :as all) (array (1)))) (len all))":                      int64(1),
+		"(let (((a b) row)) b)":                                            "2",
+		"(let (((:keys name age) person)) age)":                            int64(42),
+		`(let (((:keys (n "name")) person)) n)`:                            "rum",
+		"(let (((:keys name city :or ((city \"Floripa\"))) person)) city)": "Floripa",
+		"(let* (((:keys (p point)) nested) ((x y) p)) (+ x y))":            int64(3),
+		"((lambda ((a b) c) (+ a b c)) row-ints 3)":                        int64(6),
+		"((lambda (a & rest) (len rest)) 1 2 3)":                           int64(2),
+		"(do (def f ((:keys age)) age) (f person))":                        int64(42),
+	}
+
+	for input, expected := range valid {
+		c := NewContext(nil)
+		c.Set("row", parser.NewAny([]string{"1", "2"}, nil))
+		c.Set("row-ints", parser.NewAny([]int64{1, 2}, nil))
+		c.Set("person", parser.NewAny(map[string]interface{}{"name": "rum", "age": int64(42)}, nil))
+		c.Set("nested", parser.NewAny(map[string]interface{}{"point": []int64{1, 2}}, nil))
+		v, err := c.TryEval(mustParse(input))
+		if err != nil {
+			t.Errorf("Input %q - unexpected error: %v", input, err)
+			continue
+		}
+		if r := v.Value(); !reflect.DeepEqual(r, expected) {
+			t.Errorf("Input %q -- expected <%T>%#+v, got: <%T>%#+v", input, expected, expected, r, r)
+		}
+	}
+
+	invalid := map[string]string{
+		"(let (((a b c) (array (1 2)))) a)":       "element 2 (c) has no value",
+		"(let (((a b) (array (1 2 3)))) a)":       "expected 2 elements, got 3",
+		"(let (((a (b c)) (array (1 2)))) a)":     "element 1: ",
+		"(let (((a b) 1)) a)":                     "expected a list, got int64",
+		"(let (((:keys city) person)) city)":      `key "city" is missing`,
+		"(let (((:keys name) (array (1)))) name)": "expected a map",
+		"((lambda ((a b)) a) (array (1)))":        "element 1 (b) has no value",
+	}
+
+	for input, msg := range invalid {
+		c := NewContext(nil)
+		c.Set("person", parser.NewAny(map[string]interface{}{"name": "rum"}, nil))
+		_, err := c.TryEval(mustParse(input))
+		e, ok := err.(*Error)
+		if !ok || e.Code != ErrBinding {
+			t.Errorf("Input %q - expected a binding error, got: %v", input, err)
+			continue
+		}
+		if !strings.Contains(e.Msg, msg) {
+			t.Errorf("Input %q - expected error containing %q, got: %q", input, msg, e.Msg)
+		}
+	}
+}
+
+func TestFunctionParameters(t *testing.T) {
+	valid := map[string]interface{}{
+		"((lambda (a & rest) rest) 1)":                                               []parser.Value{},
+		"((lambda (a & rest) (len rest)) 1 2 3)":                                     int64(2),
+		"((lambda (a &optional (b 10)) (+ a b)) 1)":                                  int64(11),
+		"((lambda (a &optional (b 10)) (+ a b)) 1 2)":                                int64(3),
+		"((lambda (a &optional b) b) 1)":                                             nil,
+		"((lambda (a &optional (b (+ a 1))) b) 1)":                                   int64(2),
+		"((lambda (a &key (b 2) (c 3)) (+ a b c)) 1)":                                int64(6),
+		"((lambda (a &key (b 2) (c 3)) (+ a b c)) 1 :c 10)":                          int64(13),
+		"((lambda (a &key (b 2) (c 3)) (+ a b c)) :b 5 1)":                           int64(9),
+		"((lambda (&key b) b))":                                                      nil,
+		"((lambda (a :as all) (len all)) 1)":                                         int64(1),
+		"((lambda ((a) 1) ((a b) 2) ((a b & c) 3)) 1)":                               int64(1),
+		"((lambda ((a) 1) ((a b) 2) ((a b & c) 3)) 1 2)":                             int64(2),
+		"((lambda ((a) 1) ((a b) 2) ((a b & c) 3)) 1 2 3 4)":                         int64(3),
+		`(do (def f ((a) (f a 1)) ((a b) (+ a b))) (f 5))`:                           int64(6),
+		`(do (def opt (a &optional (b 1) & rest) (+ a b (len rest))) (opt 1 2 3 4))`: int64(5),
+		"((lambda ((a b)) ((lambda (x) (* x 10)) a)) (list 1 2))":                    int64(10),
+		":keyword": parser.Identifier(":keyword"),
+	}
+
+	for input, expected := range valid {
+		r := mustEval(input).Value()
+		if !reflect.DeepEqual(r, expected) {
+			t.Errorf("Input %q -- expected <%T>%#+v, got: <%T>%#+v", input, expected, expected, r, r)
+		}
+	}
+
+	invalid := map[string]string{
+		"((lambda (a b) a) 1)":                     "lambda expects 2 arguments, got 1 (called at line 1, col 1)",
+		"((lambda (a &optional b) a))":             "lambda expects 1 to 2 arguments, got 0",
+		"((lambda (a & b) a))":                     "lambda expects at least 1 arguments, got 0",
+		"(do (def f ((a) 1) ((a b c) 2)) (f 1 2))": "f expects 1 or 3 arguments, got 2",
+		"(do\n (def f (a) a)\n  (f))":              "f expects 1 arguments, got 0 (called at line 3, col 3)",
+	}
+
+	for input, msg := range invalid {
+		_, err := NewContext(nil).TryEval(mustParse(input))
+		e, ok := err.(*Error)
+		if !ok || e.Code != ErrArity {
+			t.Errorf("Input %q - expected an arity error, got: %v", input, err)
+			continue
+		}
+		if !strings.HasPrefix(e.Msg, msg) {
+			t.Errorf("Input %q - expected error starting with %q, got: %q", input, msg, e.Msg)
+		}
+	}
+}
+
+func TestMatch(t *testing.T) {
+	valid := map[string]interface{}{
+		`(match 1 (1 "one") (_ "other"))`:                                     "one",
+		`(match 3 (1 "one") (n (+ n 1)))`:                                     int64(4),
+		`(match "b" ("a" 1) ("b" 2) (_ 3))`:                                   int64(2),
+		`(match nil (nil "nil") (_ "other"))`:                                 "nil",
+		`(match (== 1 1) (true "yes") (false "no"))`:                          "yes",
+		`(match :b (:a 1) (:b 2) (_ 3))`:                                      int64(2),
+		`(match (array (1 2)) ((a) a) ((a b) (+ a b)) (_ 0))`:                 int64(3),
+		`(match (array (1 2 3)) ((1 & rest) (len rest)) (_ 0))`:               int64(2),
+		`(match (array (1 (2 3))) ((a (b c)) c) (_ 0))`:                       int64(3),
+		`(match row (("1" x) x) (_ 0))`:                                       "2",
+		`(match person ((:keys name (a "age")) a) (_ 0))`:                     int64(42),
+		`(match person ((:keys city) city) (_ "none"))`:                       "none",
+		`(match 5 ((:type string s) s) ((:type int64 n) (* n 2)))`:            int64(10),
+		`(match now ((:type time.Time) "time") (_ "other"))`:                  "time",
+		`(match 5 (n :when (> n 10) "big") (n "small"))`:                      "small",
+		`(match 50 (n :when (> n 10) "big") (n "small"))`:                     "big",
+		`(match (array (1 2)) ((a b) :when (== a b) "same") (_ "different"))`: "different",
+	}
+
+	for input, expected := range valid {
+		c := NewContext(nil)
+		c.RegisterType((*time.Time)(nil))
+		c.Set("now", parser.NewAny(time.Now(), nil))
+		c.Set("row", parser.NewAny([]string{"1", "2"}, nil))
+		c.Set("person", parser.NewAny(map[string]interface{}{"name": "rum", "age": int64(42)}, nil))
+		v, err := c.TryEval(mustParse(input))
+		if err != nil {
+			t.Errorf("Input %q - unexpected error: %v", input, err)
+			continue
+		}
+		if r := v.Value(); !reflect.DeepEqual(r, expected) {
+			t.Errorf("Input %q -- expected <%T>%#+v, got: <%T>%#+v", input, expected, expected, r, r)
+		}
+	}
+
+	_, err := NewContext(nil).TryEval(mustParse(`(match 3 (1 "one") (2 "two"))`))
+	if e, ok := err.(*Error); !ok || e.Code != ErrNoMatch {
+		t.Errorf("Expected a NoMatch error, got: %v", err)
+	}
+
+	// The compiled forms are cached by form, not by source: built forms can
+	// share their first clause.
+	input := `(do
+		(let c (array (1 :one)))
+		(list (eval (list (array match) 1 c)) (eval (list (array match) 2 c (array (_ :other))))))`
+	if r := PrString(mustEval(input)); r != "(:one :other)" {
+		t.Errorf("Expected (:one :other), got: %s", r)
+	}
+
+	// The cache is bounded. The forms are not exhaustive: the warnings are
+	// discarded.
+	c := NewContext(nil)
+	c.SetStderr(ioutil.Discard)
+	c.MustEval(mustParse(`(def f (n) (eval (list (array match) n (list n n))))`))
+	for i := 0; i < 2*matchCacheSize; i++ {
+		c.MustEval(parser.NewAny([]parser.Value{
+			parser.NewAny(parser.Identifier("f"), nil),
+			parser.NewAny(int64(i), nil),
+		}, nil))
+	}
+	if n := len(c.matches.clauses); n > matchCacheSize {
+		t.Errorf("Expected at most %d cached forms, got %d", matchCacheSize, n)
+	}
+}
+
+func TestTailCalls(t *testing.T) {
+	// Tail calls must not grow the Go stack: without tail call elimination,
+	// those would exceed the limit.
+	defer debug.SetMaxStack(debug.SetMaxStack(1 << 20))
+
+	valid := map[string]interface{}{
+		`(do (def count (n acc) (if (== n 0) acc (count (- n 1) (+ acc 1)))) (count 2000 0))`: int64(2000),
+		`(letrec ((even? (lambda (n) (cond ((== n 0) true) (else (odd? (- n 1))))))
+		          (odd? (lambda (n) (and (!= n 0) (even? (- n 1))))))
+		   (even? 2001))`: false,
+		`(loop ((i 0) (acc 0)) (if (== i 2000) acc (recur (+ i 1) (+ acc i))))`:                     int64(1999000),
+		`(do (def fac (n &optional (acc 1)) (if (== n 0) acc (recur (- n 1) (* acc n)))) (fac 10))`: int64(3628800),
+		`(loop ((i 0)) (when (< i 3) (recur (+ i 1))))`:                                             nil,
+	}
+
+	for input, expected := range valid {
+		r := mustEval(input).Value()
+		if !reflect.DeepEqual(r, expected) {
+			t.Errorf("Input %q -- expected <%T>%#+v, got: <%T>%#+v", input, expected, expected, r, r)
+		}
+	}
+
+	invalid := map[string]ErrorCode{
+		"(loop ((i 0)) (recur 1 2))":                 ErrArity,
+		"(loop ((i 0)) (+ 1 (recur 1)))":             ErrRecur,
+		"(loop ((i 0)) (+ 1 (if true (recur 1) 2)))": ErrRecur,
+		"(loop ((i 0)) (recur 1) i)":                 ErrRecur,
+		"(loop ((i 0)) (let ((a (recur 1))) a))":     ErrRecur,
+		"(do (def f (n) (list (recur n))) (f 1))":    ErrRecur,
+		"(do (def f (n) (when (recur n) n)) (f 1))":  ErrRecur,
+		"(recur 1)":      ErrRecur,
+		"(do (recur 1))": ErrRecur,
+		"(map (lambda (x) (loop ((i 0)) (recur))) (list 1))": ErrArity,
+	}
+	for input, code := range invalid {
+		_, err := NewContext(nil).TryEval(mustParse(input))
+		if e, ok := err.(*Error); !ok || e.Code != code {
+			t.Errorf("Input %q - expected a %s error, got: %v", input, code, err)
+		}
+	}
+}
+
+func TestIterate(t *testing.T) {
+	valid := map[string]interface{}{
+		"(for (x (array (1 2 3))) (+ x 1))":   []parser.Value{parser.NewAny(int64(2), nil), parser.NewAny(int64(3), nil), parser.NewAny(int64(4), nil)},
+		"(len (for (x nil) x))":               int64(0),
+		`(for (x "héllo") x)`:                 []interface{}{"h", "é", "l", "l", "o"},
+		"(for (i x (array (10 20))) (+ i x))": []interface{}{int64(10), int64(21)},
+		"(for (x ints) (* x 2))":              []interface{}{int64(2), int64(4)},
+		"(for ((k v) m) v)":                   []interface{}{int64(1), int64(2)},
+		"(for (k v m) k)":                     []interface{}{"a", "b"},
+		"(for (x ch) x)":                      []interface{}{"c1", "c2"},
+		"(for ((a b) (csv.new-reader (strings.new-reader \"1,2\n3,4\"))) b)": []interface{}{"2", "4"},
+		"(for (x (array (1 2))) (let y x) (+ x y))":                          []interface{}{int64(2), int64(4)},
+		"(doseq (x (array (1 2))) x)":                                        nil,
+		"(for-each (i x ints) x)":                                            nil,
+	}
+
+	for input, expected := range valid {
+		c := NewContext(nil)
+		c.Set("ints", parser.NewAny([]int64{1, 2}, nil))
+		c.Set("m", parser.NewAny(map[string]int64{"b": 2, "a": 1}, nil))
+		ch := make(chan string, 2)
+		ch <- "c1"
+		ch <- "c2"
+		close(ch)
+		c.Set("ch", parser.NewAny(ch, nil))
+		RunSExpressions(c, []string{"(import strings csv)"}, t)
+
+		v, err := c.TryEval(mustParse(input))
+		if err != nil {
+			t.Errorf("Input %q - unexpected error: %v", input, err)
+			continue
+		}
+		r := v.Value()
+		if _, ok := expected.([]interface{}); ok {
+			r = unwrap(r)
+		}
+		if !reflect.DeepEqual(r, expected) {
+			t.Errorf("Input %q -- expected <%T>%#+v, got: <%T>%#+v", input, expected, expected, r, r)
+		}
+	}
+
+	invalid := []string{
+		"(for (x 1) x)",
+		"(for (x) x)",
+		"(for (x (array (1 2))) (panic x))",
+		"(for (x (csv.new-reader (strings.new-reader \"1,2\n3\"))) x)",
+	}
+	for _, input := range invalid {
+		c := NewContext(nil)
+		RunSExpressions(c, []string{"(import strings csv)"}, t)
+		if _, err := c.TryEval(mustParse(input)); err == nil {
+			t.Errorf("Input %q should have generated an error.", input)
+		}
+	}
+}
+
+func TestSequences(t *testing.T) {
+	valid := map[string]interface{}{
+		"(list 1 (+ 1 1) \"a\")":             []interface{}{int64(1), int64(2), "a"},
+		"(list)":                             []interface{}{},
+		"(len (list 1 2))":                   int64(2),
+		"(len ints)":                         int64(3),
+		"(len m)":                            int64(2),
+		`(len "héllo")`:                      int64(5),
+		"(map (lambda (x) (* x 2)) ints)":    []interface{}{int64(2), int64(4), int64(6)},
+		"(map + (list 1 2 3) (list 10 20))":  []interface{}{int64(11), int64(22)},
+		"(map first m)":                      []interface{}{"a", "b"},
+		"(filter (lambda (x) (> x 1)) ints)": []interface{}{int64(2), int64(3)},
+		"(reduce + ints)":                    int64(6),
+		"(reduce + 10 ints)":                 int64(16),
+		"(reduce list (list))":               []interface{}{},
+		"(reduce (lambda (acc x) (+ acc x)) 0 (range 5))": int64(10),
+		"(range 3)":                           []interface{}{int64(0), int64(1), int64(2)},
+		"(range 1 3)":                         []interface{}{int64(1), int64(2)},
+		"(range 5 0 -2)":                      []interface{}{int64(5), int64(3), int64(1)},
+		"(take 2 ints)":                       []interface{}{int64(1), int64(2)},
+		"(take 5 ints)":                       []interface{}{int64(1), int64(2), int64(3)},
+		"(drop 2 ints)":                       []interface{}{int64(3)},
+		"(drop 5 ints)":                       []interface{}{},
+		"(concat ints (list 4) nil)":          []interface{}{int64(1), int64(2), int64(3), int64(4)},
+		"(reverse ints)":                      []interface{}{int64(3), int64(2), int64(1)},
+		`(sort (list 3 1.5 2))`:               []interface{}{1.5, int64(2), int64(3)},
+		`(sort (list "b" "c" "a"))`:           []interface{}{"a", "b", "c"},
+		"(sort-by (lambda (x) (- 0 x)) ints)": []interface{}{int64(3), int64(2), int64(1)},
+		"(sort-by first (list (list 2 \"b\") (list 1 \"a\")))": []interface{}{[]interface{}{int64(1), "a"}, []interface{}{int64(2), "b"}},
+		"(group-by (lambda (x) (> x 1)) ints)": map[interface{}]interface{}{
+			false: []parser.Value{parser.NewAny(int64(1), nil)},
+			true:  []parser.Value{parser.NewAny(int64(2), nil), parser.NewAny(int64(3), nil)},
+		},
+		`(frequencies "abca")`:  map[interface{}]interface{}{"a": int64(2), "b": int64(1), "c": int64(1)},
+		"(zip ints (list 4 5))": []interface{}{[]interface{}{int64(1), int64(4)}, []interface{}{int64(2), int64(5)}},
+		"(first ints)":          int64(1),
+		"(first nil)":           nil,
+		"(first m)":             []parser.Value{parser.NewAny("a", nil), parser.NewAny(int64(1), nil)},
+		"(rest ints)":           []interface{}{int64(2), int64(3)},
+		"(rest nil)":            []interface{}{},
+		"(cons 0 ints)":         []interface{}{int64(0), int64(1), int64(2), int64(3)},
+		"(nth ints 1)":          int64(2),
+		"(nth ints 5 0)":        int64(0),
+		"(some (lambda (x) (and (> x 1) (* x 10))) ints)": int64(20),
+		"(some (lambda (x) (> x 5)) ints)":                nil,
+		"(every? (lambda (x) (> x 0)) ints)":              true,
+		"(every? (lambda (x) (> x 1)) ints)":              false,
+		"(every? (lambda (x) (> x 1)) nil)":               true,
+	}
+
+	for input, expected := range valid {
+		c := NewContext(nil)
+		c.Set("ints", parser.NewAny([]int64{1, 2, 3}, nil))
+		c.Set("m", parser.NewAny(map[string]int64{"b": 2, "a": 1}, nil))
+		v, err := c.TryEval(mustParse(input))
+		if err != nil {
+			t.Errorf("Input %q - unexpected error: %v", input, err)
+			continue
+		}
+		r := v.Value()
+		if _, ok := expected.([]interface{}); ok {
+			r = unwrap(r)
+		}
+		if !reflect.DeepEqual(r, expected) {
+			t.Errorf("Input %q -- expected <%T>%#+v, got: <%T>%#+v", input, expected, expected, r, r)
+		}
+	}
+
+	invalid := []string{
+		"(nth (list 1) 3)",
+		"(map (lambda (x y) x) (list 1))",
+		"(range 1 2 0)",
+		"(map if (list 1))",
+		"(frequencies (list (list 1)))",
+	}
+	for _, input := range invalid {
+		if _, err := NewContext(nil).TryEval(mustParse(input)); err == nil {
+			t.Errorf("Input %q should have generated an error.", input)
+		}
+	}
+}
+
+func TestLazySequences(t *testing.T) {
+	valid := map[string]interface{}{
+		"(take 4 (iterate (lambda (x) (* x 2)) 1))":                                        []interface{}{int64(1), int64(2), int64(4), int64(8)},
+		`(take 2 (repeat "a"))`:                                                            []interface{}{"a", "a"},
+		"(take 5 (repeat 2 1))":                                                            []interface{}{int64(1), int64(1)},
+		"(take 5 (cycle (list 1 2)))":                                                      []interface{}{int64(1), int64(2), int64(1), int64(2), int64(1)},
+		"(take 5 (cycle nil))":                                                             []interface{}{},
+		"(take 3 (map (lambda (x) (* x x)) (iterate inc 1)))":                              []interface{}{int64(1), int64(4), int64(9)},
+		"(take 3 (map + (iterate inc 0) (list 10 20)))":                                    []interface{}{int64(10), int64(21)},
+		"(take 2 (filter (lambda (x) (> x 2)) (iterate inc 0)))":                           []interface{}{int64(3), int64(4)},
+		"(take 10 (take-while (lambda (x) (< x 3)) (iterate inc 0)))":                      []interface{}{int64(0), int64(1), int64(2)},
+		"(take-while (lambda (x) (< x 3)) (list 1 5 2))":                                   []interface{}{int64(1)},
+		"(first (drop 3 (iterate inc 0)))":                                                 int64(3),
+		"(first (rest (iterate inc 0)))":                                                   int64(1),
+		"(take 3 (cons -1 (iterate inc 0)))":                                               []interface{}{int64(-1), int64(0), int64(1)},
+		"(letrec ((nat (lambda (n) (lazy-seq (cons n (nat (+ n 1))))))) (take 3 (nat 5)))": []interface{}{int64(5), int64(6), int64(7)},
+		"(len (lazy-seq nil))":                                                             int64(0),
+		"(reduce + (take 100 (iterate inc 1)))":                                            int64(5050),
+		"(for (x (take 2 (seq ch))) x)":                                                    []interface{}{"c1", "c2"},
+		"(nth (seq (list 1 2 3)) 2)":                                                       int64(3),
+		"(take 2 (seq (bufio.new-scanner (strings.new-reader \"a\nb\nc\"))))":              []interface{}{"a", "b"},
+		"(first (seq (csv.new-reader (strings.new-reader \"1,2\n3,4\"))))":                 []string{"1", "2"},
+	}
+
+	for input, expected := range valid {
+		c := NewContext(nil)
+		c.SetFn("inc", func(v int64) int64 { return v + 1 })
+		ch := make(chan string, 3)
+		ch <- "c1"
+		ch <- "c2"
+		ch <- "c3"
+		close(ch)
+		c.Set("ch", parser.NewAny(ch, nil))
+		RunSExpressions(c, []string{"(import strings csv bufio)"}, t)
+
+		v, err := c.TryEval(mustParse(input))
+		if err != nil {
+			t.Errorf("Input %q - unexpected error: %v", input, err)
+			continue
+		}
+		r := v.Value()
+		if _, ok := expected.([]interface{}); ok {
+			r = unwrap(r)
+		}
+		if !reflect.DeepEqual(r, expected) {
+			t.Errorf("Input %q -- expected <%T>%#+v, got: <%T>%#+v", input, expected, expected, r, r)
+		}
+	}
+
+	// Elements are only realized when needed, and only once.
+	calls := 0
+	c := NewContext(nil)
+	c.SetFn("inc", func(v int64) int64 {
+		calls++
+		return v + 1
+	})
+	RunSExpressions(c, []string{"(let s (map inc (iterate inc 0)))"}, t)
+	if calls != 0 {
+		t.Errorf("Expected no call before realization, got %d", calls)
+	}
+	RunSExpressions(c, []string{"(take 3 s)"}, t)
+	if calls != 5 {
+		t.Errorf("Expected 5 calls after realizing 3 elements, got %d", calls)
+	}
+	RunSExpressions(c, []string{"(take 3 s)", "(first s)"}, t)
+	if calls != 5 {
+		t.Errorf("Expected realized elements to be cached, got %d calls", calls)
+	}
+
+	// A sequence needing itself to be realized is an error, not a deadlock.
+	for _, input := range []string{
+		"(do (let s (lazy-seq (cons 1 (first s)))) (first s))",
+		"(do (let s (lazy-seq s)) (first s))",
+	} {
+		_, err := NewContext(nil).TryEval(mustParse(input))
+		if e, ok := err.(*Error); !ok || e.Code != ErrLazySeq {
+			t.Errorf("Input %q - expected a LazySeq error, got: %v", input, err)
+		}
+	}
+
+	// Other goroutines wait for the realization of a node.
+	started, release := make(chan struct{}), make(chan struct{})
+	s := lazySeq(func() *LazySeq {
+		close(started)
+		<-release
+		return consSeq(parser.NewAny(int64(1), nil), emptySeq())
+	})
+	results := make(chan interface{}, 2)
+	realize := func() {
+		defer func() {
+			if r := recover(); r != nil {
+				results <- r
+			}
+		}()
+		v, _ := s.Iterator().Next()
+		results <- v.Value()
+	}
+	go realize()
+	<-started
+	go realize()
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	for i := 0; i < 2; i++ {
+		if r := <-results; r != int64(1) {
+			t.Errorf("Expected both goroutines to get 1, got: %v", r)
+		}
+	}
+}
+
+func TestAtoms(t *testing.T) {
+	valid := map[string]interface{}{
+		"(deref (atom 1))": int64(1),
+		"@(atom 1)":        int64(1),
+		"(let ((a (atom 1))) (swap! a + 2 3) @a)":        int64(6),
+		"(let ((a (atom 1))) (reset! a 10) @a)":          int64(10),
+		"(let ((a (atom 1))) (compare-and-set! a 1 2))":  true,
+		"(let ((a (atom 1))) (compare-and-set! a 3 2))":  false,
+		"(let ((a (atom 1))) (list @a (reset! a 2) @a))": []interface{}{int64(1), int64(2), int64(2)},
+		`(let ((a (atom 1))
+		       (log (atom (list))))
+		   (add-watch a :w (lambda (k r o n) (swap! log (lambda (l) (cons (list k o n) l)))))
+		   (reset! a 2)
+		   (swap! a + 1)
+		   (remove-watch a :w)
+		   (reset! a 4)
+		   @log)`: []interface{}{
+			[]interface{}{parser.Identifier(":w"), int64(2), int64(3)},
+			[]interface{}{parser.Identifier(":w"), int64(1), int64(2)},
+		},
+	}
+
+	for input, expected := range valid {
+		c := NewContext(nil)
+		v, err := c.TryEval(mustParse(input))
+		if err != nil {
+			t.Errorf("Input %q - unexpected error: %v", input, err)
+			continue
+		}
+		r := v.Value()
+		if _, ok := expected.([]interface{}); ok {
+			r = unwrap(r)
+		}
+		if !reflect.DeepEqual(r, expected) {
+			t.Errorf("Input %q -- expected <%T>%#+v, got: <%T>%#+v", input, expected, expected, r, r)
+		}
+	}
+
+	invalid := []string{
+		"(atom -1 :validator (lambda (x) (> x 0)))",
+		"(reset! (atom 1 :validator (lambda (x) (> x 0))) -1)",
+		"(let ((a (atom 1))) (set-validator! a (lambda (x) (> x 1))))",
+		"(deref 1)",
+	}
+	for _, input := range invalid {
+		if _, err := NewContext(nil).TryEval(mustParse(input)); err == nil {
+			t.Errorf("Input %q - expected an error", input)
+		}
+	}
+
+	// Concurrent swaps are all applied.
+	c := NewContext(nil)
+	a := c.MustEval(mustParse("(atom 0)")).Value()
+	incr := c.MustEval(mustParse("(lambda (x) (+ x 1))")).Value()
+	done := make(chan bool)
+	for i := 0; i < 10; i++ {
+		go func() {
+			for j := 0; j < 20; j++ {
+				SwapAtom(a, incr)
+			}
+			done <- true
+		}()
+	}
+	for i := 0; i < 10; i++ {
+		<-done
+	}
+	if v := Deref(a); v != int64(200) {
+		t.Errorf("Expected 200 after concurrent swaps, got %v", v)
+	}
+}
+
+func TestRebinding(t *testing.T) {
+	valid := map[string]interface{}{
+		"(let ((a 1)) (set! a 2) a)":                                   int64(2),
+		"(let ((a 1)) (let ((b 0)) (set! a 3)) a)":                     int64(3),
+		"(let ((n 0)) (def incr () (set! n (+ n 1))) (incr) (incr) n)": int64(2),
+		"(begin (def f () 1) (def f () 2) (f))":                        int64(2),
+	}
+	for input, expected := range valid {
+		v, err := NewContext(nil).TryEval(mustParse(input))
+		if err != nil {
+			t.Errorf("Input %q - unexpected error: %v", input, err)
+			continue
+		}
+		if !reflect.DeepEqual(v.Value(), expected) {
+			t.Errorf("Input %q -- expected %#+v, got: %#+v", input, expected, v.Value())
+		}
+	}
+
+	invalid := []string{
+		"(set! a 1)",
+		"(set! 1 2)",
+		"(begin (let a 1) (let a 2))",
+	}
+	for _, input := range invalid {
+		if _, err := NewContext(nil).TryEval(mustParse(input)); err == nil {
+			t.Errorf("Input %q - expected an error", input)
+		}
+	}
+
+	// Redefinitions are allowed in interactive mode.
+	c := NewContext(nil)
+	c.AllowRedefinition(true)
+	RunSExpressions(c, []string{"(let a 1)", "(let a 2)", "(def f () 1)", "(def f () 2)"}, t)
+	if v := c.MustEval(mustParse("(list a (f))")).Value(); !reflect.DeepEqual(unwrap(v), []interface{}{int64(2), int64(2)}) {
+		t.Errorf("Expected redefined values, got %v", v)
+	}
+
+	// Nothing can be changed in an immutable context.
+	for _, input := range []string{
+		"(begin (let a 1) (let a 2))",
+		"(begin (def f () 1) (def f () 2))",
+		"(let ((a 1)) (set! a 2))",
+	} {
+		c := NewContext(nil)
+		c.AllowRedefinition(true)
+		c.SetImmutable(true)
+		if _, err := c.TryEval(mustParse(input)); err == nil {
+			t.Errorf("Input %q - expected an error in an immutable context", input)
+		}
+	}
+}
+
+func TestRecords(t *testing.T) {
+	valid := map[string]interface{}{
+		"(Point? (Point 1 2))":                            true,
+		"(Point? 1)":                                      false,
+		"(Point-x (Point 1 2))":                           int64(1),
+		"(. (Point 1 2) y)":                               int64(2),
+		"(get (Point 1 2) :y)":                            int64(2),
+		"(get (Point 1 2) \"x\")":                         int64(1),
+		"(get (Point 1 2) :z 3)":                          int64(3),
+		"(Point-x (assoc (Point 1 2) :x 5))":              int64(5),
+		"(== (Point 1 2) (Point 1 2))":                    true,
+		"(== (Point 1 2) (Point 2 1))":                    false,
+		"(type (Point 1 2))":                              "Point",
+		"(match (Point 1 2) ((:type Point (:keys y)) y))": int64(2),
+		"(let (((:keys x y) (Point 1 2))) (+ x y))":       int64(3),
+		"(get (list 1 2) 1)":                              int64(2),
+		"(get nil :a 4)":                                  int64(4),
+		"(assoc (list 1 2) 0 3)":                          []interface{}{int64(3), int64(2)},
+	}
+
+	for input, expected := range valid {
+		c := NewContext(nil)
+		RunSExpressions(c, []string{"(defrecord Point (x y))"}, t)
+		v, err := c.TryEval(mustParse(input))
+		if err != nil {
+			t.Errorf("Input %q - unexpected error: %v", input, err)
+			continue
+		}
+		r := v.Value()
+		if _, ok := expected.([]interface{}); ok {
+			r = unwrap(r)
+		}
+		if !reflect.DeepEqual(r, expected) {
+			t.Errorf("Input %q -- expected <%T>%#+v, got: <%T>%#+v", input, expected, expected, r, r)
+		}
+	}
+
+	invalid := []string{
+		"(Point 1)",
+		"(Point-x 1)",
+		"(assoc (Point 1 2) :z 3)",
+		"(defrecord Pair (a a))",
+	}
+	for _, input := range invalid {
+		c := NewContext(nil)
+		RunSExpressions(c, []string{"(defrecord Point (x y))"}, t)
+		if _, err := c.TryEval(mustParse(input)); err == nil {
+			t.Errorf("Input %q - expected an error", input)
+		}
+	}
+
+	// Records can be inspected from Go.
+	c := NewContext(nil)
+	RunSExpressions(c, []string{"(defrecord Point (x y))"}, t)
+	r, ok := c.MustEval(mustParse("(Point 1 \"a\")")).Value().(*Record)
+	if !ok {
+		t.Fatalf("Expected a record")
+	}
+	if r.Type.Name != "Point" || !reflect.DeepEqual(r.Type.Fields, []string{"x", "y"}) {
+		t.Errorf("Unexpected record type %#+v", r.Type)
+	}
+	if m := r.Map(); !reflect.DeepEqual(m, map[string]interface{}{"x": int64(1), "y": "a"}) {
+		t.Errorf("Unexpected record fields %v", m)
+	}
+	if s := r.String(); s != `(Point 1 "a")` {
+		t.Errorf("Unexpected record representation %q", s)
+	}
+}
+
+func TestProtocols(t *testing.T) {
+	valid := map[string]interface{}{
+		"(area (Circle 2))":             int64(12),
+		"(area (Square 3))":             int64(9),
+		"(area 7)":                      int64(7),
+		"(name (Circle 1))":             "circle",
+		"(name (Square 1))":             "stringer",
+		"(name 1)":                      "thing",
+		"(name (transport))":            "transport",
+		"(name (duration 1))":           "stringer",
+		"(satisfies? Shape (Circle 1))": true,
+		"(greet (Circle 1))":            "hello",
+		"(greet m)":                     "bonjour",
+		"(kind 1 2)":                    "three",
+		"(kind 2 2)":                    "other",
+	}
+
+	setup := []string{
+		"(defrecord Circle (r))",
+		"(defrecord Square (s))",
+		"(defprotocol Shape (area s) (name s))",
+		"(extend-type Circle Shape (area (c) (* 3 (Circle-r c) (Circle-r c))) (name (c) \"circle\"))",
+		"(extend-type Square Shape (area (s) (* (Square-s s) (Square-s s))))",
+		"(extend-type int64 Shape (area (n) n))",
+		"(extend-type net/http.Transport Shape (name (t) \"transport\"))",
+		"(extend-type fmt.Stringer Shape (name (t) \"stringer\"))",
+		"(extend-type string Shape (name (t) t))",
+		"(extend-type :default Shape (name (x) \"thing\"))",
+		"(defmulti greet :lang)",
+		"(defmethod greet \"fr\" (m) \"bonjour\")",
+		"(defmethod greet :default (m) \"hello\")",
+		"(defmulti kind (lambda (x y) (+ x y)))",
+		"(defmethod kind 3 (x y) \"three\")",
+		"(defmethod kind :default (x y) \"other\")",
+	}
+
+	newContext := func() *Context {
+		c := NewContext(nil)
+		c.RegisterType((*http.Transport)(nil))
+		c.RegisterType((*fmt.Stringer)(nil))
+		c.SetFn("transport", func() *http.Transport { return &http.Transport{} })
+		c.SetFn("duration", func(n int64) time.Duration { return time.Duration(n) })
+		c.Set("m", parser.NewAny(map[string]interface{}{"lang": "fr"}, nil))
+		RunSExpressions(c, setup, t)
+		return c
+	}
+
+	for input, expected := range valid {
+		v, err := newContext().TryEval(mustParse(input))
+		if err != nil {
+			t.Errorf("Input %q - unexpected error: %v", input, err)
+			continue
+		}
+		if !reflect.DeepEqual(v.Value(), expected) {
+			t.Errorf("Input %q -- expected %#+v, got: %#+v", input, expected, v.Value())
+		}
+	}
+
+	invalid := map[string]ErrorCode{
+		"(area \"a\")":                           ErrNoMethod,
+		"(begin (defmulti f :a) (f (Circle 1)))": ErrNoMethod,
+		"(area)":                                 ErrArity,
+		"(extend-type int64 Shape (perimeter (n) n))": ErrPanic,
+	}
+	for input, code := range invalid {
+		_, err := newContext().TryEval(mustParse(input))
+		if err == nil {
+			t.Errorf("Input %q - expected an error", input)
+			continue
+		}
+		if e, ok := err.(*Error); !ok || e.Code != code {
+			t.Errorf("Input %q - expected error %s, got: %v", input, code, err)
+		}
+	}
+}
+
+func TestCompile(t *testing.T) {
+	exprs := []string{
+		"(+ 1 2)",
+		"(+ 1.5 2)",
+		"(- 10 1 2)",
+		"(* 2 3 4)",
+		"(list 1 (< 1 2) (>= 1 2) (== 1 1 1) (!= 1 2) (not nil))",
+		"(if (< 1 2) :yes :no)",
+		"(if false 1 2 3)",
+		"(if false 1 (do 2 3))",
+		"(if false 1)",
+		"(when true 1 2)",
+		"(when false 1)",
+		"(unless false 1)",
+		"(and 1 nil 2)",
+		"(and 1 2)",
+		"(and)",
+		"(or nil false 3)",
+		"(or)",
+		"(cond (false 1) (nil 2) (3) (else 4))",
+		"(cond (false 1) (else 2 3))",
+		"(cond (false 1))",
+		"(begin 1 2 3)",
+		"(do)",
+		"(let ((a 1) (b 2)) (+ a b))",
+		"(let ((a 1)) (let ((a 2) (b a)) (list a b)))",
+		"(let* ((a 1) (b (+ a 1)) (a (* b 10))) (list a b))",
+		"(begin (let a 5) (+ a 1))",
+		"(package \"main\" (def when (x) x) (when 5))",
+		"(begin (def + (a b) (list a b)) (+ 1 2))",
+		"(begin (def add (a b) (+ a b)) (add 1 2))",
+		"(begin (def f (a & rest) (list a rest)) (list (f 1) (f 1 2 3)))",
+		"((lambda (a &optional b) (list a b)) 1)",
+		"((lambda ((a b)) ((lambda (x) (* x 10)) a)) (list 1 2))",
+		"(package \"main\" (match 1 (_ 0)) (def f (x) (* x 2)) (f 3))",
+		"((lambda (x) (* x x)) 7)",
+		"(begin (def adder (n) (lambda (x) (+ x n))) ((adder 2) 3))",
+		"(begin (def f (a) (lambda (b) (lambda (c) (list a b c)))) (((f 1) 2) 3))",
+		"(begin (def f (n) (let x (* n 2)) (+ x 1)) (f 3))",
+		"(begin (def g (n) (let f (lambda (k) (if (== k 0) 0 (+ 1 (f (- k 1)))))) (f n)) (g 3))",
+		"(loop ((i 0) (acc (list))) (if (== i 3) acc (recur (+ i 1) (cons i acc))))",
+		"(begin (def sum (n acc) (if (== n 0) acc (recur (- n 1) (+ acc n)))) (sum 100 0))",
+		"(begin (def fac (n) (if (== n 0) 1 (* n (fac (- n 1))))) (fac 10))",
+		"(map (lambda (x) (+ x 1)) (list 1 2 3))",
+		"(array (1 2))",
+		"(begin (def f (x) (match x ((a b) (+ a b)) (_ 0))) (list (f (list 1 2)) (f 3)))",
+		"(let ((xs (list 1 2))) (for (x xs) (* x 10)))",
+		"(begin (let a 1) (let a 2))",
+		"(+ 1 \"a\")",
+		"(undefined 1)",
+		"((lambda (x) x))",
+		"(recur 1)",
+		"(loop ((i 0)) (+ 1 (recur i)))",
+	}
+
+	for _, input := range exprs {
+		expected, expectedErr := NewContext(nil).TryEval(mustParse(input))
+		v, err := Compile(NewContext(nil), mustParse(input)).Run()
+		if (err == nil) != (expectedErr == nil) {
+			t.Errorf("Input %q - expected error %v, got: %v", input, expectedErr, err)
+			continue
+		}
+		if err != nil {
+			if err.(*Error).Code != expectedErr.(*Error).Code {
+				t.Errorf("Input %q - expected error %v, got: %v", input, expectedErr, err)
+			}
+			continue
+		}
+		if !reflect.DeepEqual(unwrap(v.Value()), unwrap(expected.Value())) {
+			t.Errorf("Input %q -- expected %#+v, got: %#+v", input, expected.Value(), v.Value())
+		}
+	}
+
+	// The scopes are restored after the forms evaluated by the interpreter:
+	// the later definitions are global.
+	for _, input := range []string{
+		"(begin (let ((a 1)) (match a (_ 0))) (let b 2) b)",
+		"(begin (let* ((a 1)) (match a (_ 0))) (let b 2) b)",
+		"(begin (loop ((a 1)) (match a (_ 0))) (let b 2) b)",
+	} {
+		c := NewContext(nil)
+		c.SetStderr(ioutil.Discard)
+		if _, err := Compile(c, mustParse(input)).Run(); err != nil {
+			t.Errorf("Input %q - unexpected error: %v", input, err)
+		}
+		if v, err := c.TryEval(mustParse("b")); err != nil || v.Value() != int64(2) {
+			t.Errorf("Input %q - expected b to be global, got: %v, %v", input, v, err)
+		}
+	}
+
+	// Tail calls between compiled functions don't grow the stack.
+	prev := debug.SetMaxStack(1 << 20)
+	defer debug.SetMaxStack(prev)
+	p := Compile(NewContext(nil), mustParse(`(begin
+		(def even? (n) (if (== n 0) true (odd? (- n 1))))
+		(def odd? (n) (if (== n 0) false (even? (- n 1))))
+		(even? 100001))`))
+	if v, err := p.Run(); err != nil || v.Value() != false {
+		t.Errorf("Expected false, got %v, %v", v, err)
+	}
+
+	// Errors point to the source of the failing call.
+	_, err := Compile(NewContext(nil), mustParse("(begin\n  (def f (x) (+ x \"a\"))\n  (list (f 1)))")).Run()
+	if err == nil {
+		t.Fatalf("Expected an error")
+	}
+	stack := err.(*Error).Stack
+	if len(stack) < 2 || stack[0].Ref().Line != 1 || stack[len(stack)-1].Ref().Line != 2 {
+		t.Errorf("Unexpected error stack: %v", err)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	valid := []string{
+		"(begin (def f () (g 1)) (def g (x) x) (f))",
+		"(begin (defrecord Point (x y)) (Point-x (Point 1 2)))",
+		"(begin (defprotocol Named (name)) (extend-type string Named (name (s) s)) (name \"a\"))",
+		"(begin (import strings) (strings.to-upper \"a\"))",
+		"(begin (case 1 1 (let a 2)) a)",
+		"(begin (eval (list (quote def) (quote f) (list) 1)) (f))",
+	}
+	for _, input := range valid {
+		if err := Compile(NewContext(nil), mustParse(input)).Check(); err != nil {
+			t.Errorf("Input %q - unexpected error: %v", input, err)
+		}
+	}
+
+	// Nothing is executed when a variable is undefined, even if it is never
+	// reached.
+	c := NewContext(nil)
+	a := NewAtom(parser.NewAny(int64(0), nil))
+	c.Set("a", parser.NewAny(a, nil))
+	p := Compile(c, mustParse("(begin\n  (reset! a 1)\n  (def f (x) (if x (g x) (h))))"))
+	_, err := p.Run()
+	if err == nil {
+		t.Fatalf("Expected an error")
+	}
+	e := err.(*Error)
+	expected := `"g" does not exist (line 3, col 21); "h" does not exist (line 3, col 27)`
+	if e.Code != ErrUnknownVariable || e.Msg != expected || len(e.Stack) != 1 {
+		t.Errorf("Expected %q, got: %v", expected, err)
+	}
+	if v := a.Deref().Value(); v != int64(0) {
+		t.Errorf("Expected the program not to run, atom is %v", v)
+	}
+
+	// The forms of a package are checked even if one of them is interpreted.
+	err = Compile(NewContext(nil), mustParse("(package \"main\" (match 1 (_ 0)) (g 1))")).Check()
+	if err == nil || err.(*Error).Msg != `"g" does not exist (line 1, col 34)` {
+		t.Errorf("Expected g not to exist, got: %v", err)
+	}
+}
+
+func TestLimits(t *testing.T) {
+	loop := "(loop ((i 0)) (recur (+ i 1)))"
+	deep := "(begin (def f (n) (+ 1 (f n))) (f 1))"
+	cases := []struct {
+		limits Limits
+		input  string
+		code   ErrorCode
+	}{
+		{Limits{Steps: 1000}, loop, ErrStepLimit},
+		{Limits{Depth: 200}, deep, ErrDepthLimit},
+		{Limits{Timeout: 20 * time.Millisecond}, loop, ErrTimeout},
+		{Limits{Memory: 1 << 20}, `(loop ((s "")) (recur (sprintf "%s%s" s "abcdefgh")))`, ErrMemoryLimit},
+		{Limits{Memory: 1 << 20}, "(loop ((xs (list))) (recur (cons 1 xs)))", ErrMemoryLimit},
+		// The lists are charged before they are built.
+		{Limits{Memory: 1 << 20}, "(len (range 20000000))", ErrMemoryLimit},
+		{Limits{Memory: 1 << 20}, "(len (range 9223372036854775807 -9223372036854775807 -1))", ErrMemoryLimit},
+		{Limits{Memory: 1 << 20}, "(len (concat (list 1) (repeat 20000000 1)))", ErrMemoryLimit},
+		{Limits{Memory: 1 << 20}, "(len (take 20000000 (repeat 1)))", ErrMemoryLimit},
+		// Values count for the whole evaluation: s is rebound to a short string.
+		{Limits{Memory: 1 << 16}, `(loop ((s "")) (recur (sprintf "%s" "abcdefgh")))`, ErrMemoryLimit},
+	}
+
+	for _, tc := range cases {
+		c := NewContext(nil)
+		c.SetLimits(tc.limits)
+		_, err := c.TryEval(mustParse(tc.input))
+		if err == nil || err.(*Error).Code != tc.code {
+			t.Errorf("Input %q with %+v - expected error %s, got: %v", tc.input, tc.limits, tc.code, err)
+		}
+
+		c = NewContext(nil)
+		c.SetLimits(tc.limits)
+		_, err = Compile(c, mustParse(tc.input)).Run()
+		if err == nil || err.(*Error).Code != tc.code {
+			t.Errorf("Input %q with %+v compiled - expected error %s, got: %v", tc.input, tc.limits, tc.code, err)
+		}
+
+		// The limits apply to each evaluation.
+		if v, err := c.TryEval(mustParse("(+ 1 2)")); err != nil || v.Value() != int64(3) {
+			t.Errorf("Expected 3 after the limit, got %v, %v", v, err)
+		}
+	}
+
+	// Bindings count towards the memory quota while their scope runs.
+	c := NewContext(nil)
+	c.SetLimits(Limits{Memory: 1 << 12})
+	if _, err := c.TryEval(mustParse(deep)); err == nil || err.(*Error).Code != ErrMemoryLimit {
+		t.Errorf("Expected the bindings to exceed the memory quota, got: %v", err)
+	}
+	if _, err := Compile(c, mustParse(deep)).Run(); err == nil || err.(*Error).Code != ErrMemoryLimit {
+		t.Errorf("Expected the compiled bindings to exceed the memory quota, got: %v", err)
+	}
+	for _, input := range []string{
+		"(loop ((i 0)) (if (< i 20000) (recur (+ i 1)) i))",
+		"(begin (def f (i) (if (< i 20000) (f (+ i 1)) i)) (f 0))",
+		"(begin (def f (i) (let ((j (+ i 1))) (if (< j 20000) (f j) j))) (f 0))",
+		"(begin (for-each (i (range 20000)) (let ((j i)) j)) 20000)",
+	} {
+		c = NewContext(nil)
+		c.SetLimits(Limits{Memory: 1 << 20})
+		if v, err := c.TryEval(mustParse(input)); err != nil || v.Value() != int64(20000) {
+			t.Errorf("Input %q - expected 20000 in constant space, got: %v, %v", input, v, err)
+		}
+		c = NewContext(nil)
+		c.SetLimits(Limits{Memory: 1 << 20})
+		if v, err := Compile(c, mustParse(input)).Run(); err != nil || v.Value() != int64(20000) {
+			t.Errorf("Input %q compiled - expected 20000 in constant space, got: %v, %v", input, v, err)
+		}
+	}
+
+	// Cancellation reaches channel receives and the goroutines evaluating
+	// functions.
+	c = NewContext(nil)
+	c.Set("ch", parser.NewAny(make(chan int), nil))
+	c.Set("spawn", parser.NewAny(func(f *Function) interface{} {
+		errs := make(chan interface{})
+		go func() {
+			defer func() { errs <- recover() }()
+			f.Apply()
+		}()
+		return <-errs
+	}, nil))
+	for _, input := range []string{"(for-each (x ch) x)", loop} {
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(10*time.Millisecond, cancel)
+		_, err := c.TryEvalContext(ctx, mustParse(input))
+		if err == nil || err.(*Error).Code != ErrCanceled {
+			t.Errorf("Input %q - expected to be canceled, got: %v", input, err)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	v, err := c.TryEvalContext(ctx, mustParse("(spawn (lambda () "+loop+"))"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if e, ok := v.Value().(*Error); !ok || e.Code != ErrTimeout {
+		t.Errorf("Expected the goroutine to time out, got: %v", v.Value())
+	}
+
+	// A call which joins a running evaluation still honors its context and
+	// its time limit, and stops the evaluation it joined.
+	for _, limits := range []Limits{{}, {Timeout: 10 * time.Millisecond}} {
+		c = NewContext(nil)
+		c.SetLimits(limits)
+		first := make(chan error)
+		ctx, cancel := context.WithCancel(context.Background())
+		go func() {
+			_, err := c.TryEvalContext(ctx, mustParse(loop))
+			first <- err
+		}()
+		for c.current() == nil {
+			time.Sleep(time.Millisecond)
+		}
+		joined, stop := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		start := time.Now()
+		_, err = c.TryEvalContext(joined, mustParse(loop))
+		stop()
+		if err == nil || err.(*Error).Code != ErrTimeout || time.Since(start) > 5*time.Second {
+			t.Errorf("With %+v - expected the joined call to time out, got: %v after %s", limits, err, time.Since(start))
+		}
+		if err := <-first; err == nil || err.(*Error).Code != ErrTimeout {
+			t.Errorf("With %+v - expected the first call to stop, got: %v", limits, err)
+		}
+		cancel()
+	}
+}
+
+func TestIO(t *testing.T) {
+	var out, errs bytes.Buffer
+	c := NewContext(nil)
+	c.SetStdout(&out)
+	c.SetStderr(&errs)
+	c.SetStdin(strings.NewReader("a\nb\n"))
+	c.AllowRedefinition(true)
+	RunSExpressions(c, []string{
+		`(println 1 "a")`,
+		`(print 2 "b")`,
+		`(fprintf *out* "-%d" 3)`,
+		`(fprintf *err* "error")`,
+		`(let x 1)`,
+		`(let x 2)`,
+	}, t)
+	if out.String() != "1 a\n2 b-3" {
+		t.Errorf("Unexpected output: %q", out.String())
+	}
+	if !strings.HasPrefix(errs.String(), "error") || !strings.Contains(errs.String(), "warning: line 1, col 8: redefining x") {
+		t.Errorf("Unexpected error output: %q", errs.String())
+	}
+
+	RunSExpressions(c, []string{"(import bufio)"}, t)
+	v := c.MustEval(mustParse("(for (l (bufio.new-scanner *in*)) l)"))
+	if lines := unwrap(v.Value()); !reflect.DeepEqual(lines, []interface{}{"a", "b"}) {
+		t.Errorf("Unexpected input: %v", lines)
+	}
+
+	// Child contexts inherit the streams, unless they have their own.
+	var nested bytes.Buffer
+	child := NewContext(c)
+	c.MustEval(mustParse(`(println "parent")`))
+	child.MustEval(mustParse(`(println "inherited")`))
+	child.SetStdout(&nested)
+	child.MustEval(mustParse(`(println "child")`))
+	if out.String() != "1 a\n2 b-3parent\ninherited\n" || nested.String() != "child\n" {
+		t.Errorf("Unexpected outputs: %q and %q", out.String(), nested.String())
+	}
+
+	// Concurrent evaluations have separate outputs.
+	outputs := make([]bytes.Buffer, 4)
+	done := make(chan bool)
+	for i := range outputs {
+		go func(i int) {
+			c := NewContext(nil)
+			c.SetStdout(&outputs[i])
+			c.MustEval(mustParse(fmt.Sprintf("(for-each (x (range 100)) (print %d))", i)))
+			done <- true
+		}(i)
+	}
+	for range outputs {
+		<-done
+	}
+	for i := range outputs {
+		if expected := strings.Repeat(fmt.Sprint(i), 100); outputs[i].String() != expected {
+			t.Errorf("Unexpected output %d: %q", i, outputs[i].String())
+		}
+	}
+
+	// The streams need a capability.
+	c = NewContextWithOptions(Options{Capabilities: CapPure})
+	for _, input := range []string{`(println "a")`, "*out*"} {
+		if _, err := c.TryEval(mustParse(input)); err == nil {
+			t.Errorf("Input %q - expected an error", input)
+		}
+	}
+}
+
+func TestPrinter(t *testing.T) {
+	tests := []struct {
+		input    string
+		readable string
+		display  string
+	}{
+		{"1", "1", "1"},
+		{"2.0", "2.0", "2.0"},
+		{"-1.5", "-1.5", "-1.5"},
+		{"nil", "nil", "nil"},
+		{"true", "true", "true"},
+		{"\"a \\\"b\\\" \\\\\"", `"a \"b\" \\"`, `a "b" \`},
+		{":key", ":key", ":key"},
+		{"(list 1 \"a\" (list :b nil))", `(1 "a" (:b nil))`, "(1 a (:b nil))"},
+		{"(list)", "()", "()"},
+		{"(take 3 (iterate (lambda (x) (+ x 1)) 0))", "(0 1 2)", "(0 1 2)"},
+		{"(frequencies (list \"b\" \"a\" \"b\"))", `(("a" 1) ("b" 2))`, "((a 1) (b 2))"},
+		{"(begin (defrecord P (x y)) (P 1 \"a\"))", `(P 1 "a")`, "(P 1 a)"},
+		{"(atom (list 1))", "(atom (1))", "(atom (1))"},
+		{"(repeat 1)", "(" + strings.Repeat("1 ", printLength) + "...)", "(" + strings.Repeat("1 ", printLength) + "...)"},
+		{"(begin (def f (x) x) f)", "<function f>", "<function f>"},
+	}
+	for _, test := range tests {
+		v, err := NewContext(nil).TryEval(mustParse(test.input))
+		if err != nil {
+			t.Errorf("Input %q - unexpected error: %v", test.input, err)
+			continue
+		}
+		if s := PrString(v); s != test.readable {
+			t.Errorf("Input %q - expected readable %q, got %q", test.input, test.readable, s)
+		}
+		if s := DisplayString(v); s != test.display {
+			t.Errorf("Input %q - expected display %q, got %q", test.input, test.display, s)
+		}
+		if _, err := parser.Parse(parser.NewSource(PrString(v))); err != nil && !strings.HasPrefix(test.readable, "<") {
+			t.Errorf("Input %q - unable to read %q back: %v", test.input, PrString(v), err)
+		}
+	}
+
+	var out bytes.Buffer
+	c := NewContext(nil)
+	c.SetStdout(&out)
+	RunSExpressions(c, []string{
+		`(println "a" 1 (list "b"))`,
+		`(prn "a" 1 (list "b"))`,
+		`(pr "c")`,
+	}, t)
+	if expected := "a 1 (b)\n\"a\" 1 (\"b\")\n\"c\""; out.String() != expected {
+		t.Errorf("Expected output %q, got %q", expected, out.String())
+	}
+
+	for input, expected := range map[string]string{
+		`(str "a" 1 nil (list "b") :c)`: "a1(b):c",
+		`(str)`:                         "",
+		`(pr-str "a" 1 (list "b"))`:     `"a" 1 ("b")`,
+	} {
+		if v := mustEval(input).Value(); v != expected {
+			t.Errorf("Input %q - expected %q, got %q", input, expected, v)
+		}
+	}
+}
+
+func TestExamples(t *testing.T) {
+	tests := map[string]string{
+		"../examples/cheat-sheet.rum":   "csv read all: ((1 2 3 4))\n",
+		"../examples/math/fatorial.rum": "factorial with loop 120",
+	}
+	for file, expected := range tests {
+		src, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var out bytes.Buffer
+		c := NewContext(nil)
+		c.SetStdout(&out)
+		if _, err := Compile(c, mustParse(string(src))).Run(); err != nil {
+			t.Errorf("File %s - unexpected error: %v", file, err)
+			continue
+		}
+		if !strings.Contains(out.String(), expected) {
+			t.Errorf("File %s - expected %q in the output, got %q", file, expected, out.String())
+		}
+	}
+}
+
+func TestImport(t *testing.T) {
+	valid := map[string]interface{}{
+		`(begin (import strings) (strings.to-upper "a"))`:           "A",
+		`(begin (import (s "strings")) (s.to-upper "a"))`:           "A",
+		`(begin (import (map "strings")) (map.to-upper "a"))`:       "A",
+		`(begin (import (str "strings")) (str (str.to-lower "A")))`: "a",
+		// The builtin named like an alias is kept.
+		`(begin (import (map "strings")) (first (map map.to-upper (list "a"))))`: "A",
+	}
+	for input, expected := range valid {
+		if v := mustEval(input); v.Value() != expected {
+			t.Errorf("Input %q - expected %v, got: %v", input, expected, v.Value())
+		}
+	}
+
+	// The alias itself is not bound.
+	if _, err := NewContext(nil).TryEval(mustParse(`(begin (import (s "strings")) s)`)); err == nil || err.(*Error).Code != ErrUnknownVariable {
+		t.Errorf("Expected the alias not to be defined, got: %v", err)
+	}
+}
+
+// benchmarkEval evaluates input repeatedly, in a context where setup was
+// evaluated.
+func benchmarkEval(b *testing.B, setup, input string, debug bool) {
+	c := NewContext(nil)
+	c.SetDebug(debug)
+	c.MustEval(mustParse(setup))
+	root := mustParse(input)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c.TryEval(root)
+	}
+}
+
+// BenchmarkEvalCall measures the overhead of evaluating a function call.
+func BenchmarkEvalCall(b *testing.B) {
+	benchmarkEval(b, "(def f (n) n)", "(f 1)", false)
+}
+
+// BenchmarkEvalLoop measures a loop evaluating many nodes.
+func BenchmarkEvalLoop(b *testing.B) {
+	benchmarkEval(b, "()", "(loop ((i 0) (acc 0)) (if (== i 100) acc (recur (+ i 1) (+ acc i))))", false)
+}
+
+// BenchmarkEvalError measures the cost of an error, without and with the
+// collection of the Go stack.
+func BenchmarkEvalError(b *testing.B) {
+	benchmarkEval(b, `(def f (n) (+ n "a"))`, "(f 1)", false)
+}
+
+func BenchmarkEvalErrorDebug(b *testing.B) {
+	benchmarkEval(b, `(def f (n) (+ n "a"))`, "(f 1)", true)
+}
+
+// BenchmarkCompiledLoop is BenchmarkEvalLoop with the bytecode compiler.
+func BenchmarkCompiledLoop(b *testing.B) {
+	p := Compile(NewContext(nil), mustParse("(loop ((i 0) (acc 0)) (if (== i 100) acc (recur (+ i 1) (+ acc i))))"))
+	for i := 0; i < b.N; i++ {
+		p.Run()
+	}
+}
@@ -0,0 +1,410 @@
+package runtime
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+
+	"github.com/rumlang/rum/parser"
+)
+
+// The sequence functions work on any value supported by Iterate: Rum lists,
+// Go slices, maps (as (key value) entries), strings, channels... They return
+// Rum lists - except map, filter, take-while, drop and rest which return lazy
+// sequences when working on lazy sequences.
+
+// Apply calls fn - a Rum function or a Go function - with the provided
+// evaluated arguments and returns its result.
+func Apply(fn interface{}, args ...parser.Value) parser.Value {
+	if _, ok := fn.(Internal); ok {
+		panic("Special forms can not be used as functions")
+	}
+	return resolve(call(parser.NewAny(fn, nil), args, nil))
+}
+
+// toValues returns all the elements of coll.
+func toValues(coll interface{}) []parser.Value {
+	if list, ok := coll.([]parser.Value); ok {
+		return list
+	}
+	values := []parser.Value{}
+	it := MustIterate(coll)
+	for v, ok := it.Next(); ok; v, ok = it.Next() {
+		values = append(values, v)
+	}
+	return values
+}
+
+// List implements the list function, returning a list of its arguments.
+func List(values ...interface{}) []parser.Value {
+	list := make([]parser.Value, len(values))
+	for i, v := range values {
+		list[i] = parser.NewAny(v, nil)
+	}
+	return list
+}
+
+// Length implements the len function.
+func Length(coll interface{}) int64 {
+	if list, ok := coll.([]parser.Value); ok {
+		return int64(len(list))
+	}
+	if s, ok := coll.(string); ok {
+		return int64(len([]rune(s)))
+	}
+	if coll != nil {
+		switch rv := reflect.ValueOf(coll); rv.Kind() {
+		case reflect.Slice, reflect.Array, reflect.Map, reflect.Chan:
+			return int64(rv.Len())
+		}
+	}
+	return int64(len(toValues(coll)))
+}
+
+// Map implements the map function: (map fn coll...). fn is called with one
+// element of each collection, until the shortest one is exhausted.
+func Map(fn interface{}, colls ...interface{}) interface{} {
+	if len(colls) == 0 {
+		panic("Function 'map' should take at least one collection")
+	}
+	if isLazy(colls...) {
+		return lazyMap(fn, colls)
+	}
+	result := []parser.Value{}
+	for _, args := range zip(colls) {
+		result = append(result, Apply(fn, args...))
+	}
+	return result
+}
+
+// zip returns lists of the elements of each collection with the same index,
+// until the shortest collection is exhausted.
+func zip(colls []interface{}) [][]parser.Value {
+	its := make([]Iterator, len(colls))
+	for i, coll := range colls {
+		its[i] = MustIterate(coll)
+	}
+	var result [][]parser.Value
+	for {
+		args := make([]parser.Value, len(its))
+		for i, it := range its {
+			v, ok := it.Next()
+			if !ok {
+				return result
+			}
+			args[i] = v
+		}
+		result = append(result, args)
+	}
+}
+
+// Zip implements the zip function, returning lists with one element of each
+// collection.
+func Zip(colls ...interface{}) []parser.Value {
+	result := []parser.Value{}
+	for _, elts := range zip(colls) {
+		result = append(result, parser.NewAny(elts, nil))
+	}
+	return result
+}
+
+// Filter implements the filter function: (filter pred coll). It returns the
+// elements for which pred is true.
+func Filter(pred interface{}, coll interface{}) interface{} {
+	if isLazy(coll) {
+		return lazyFilter(pred, coll)
+	}
+	result := []parser.Value{}
+	it := MustIterate(coll)
+	for v, ok := it.Next(); ok; v, ok = it.Next() {
+		if Truthy(Apply(pred, v).Value()) {
+			result = append(result, v)
+		}
+	}
+	return result
+}
+
+// Reduce implements the reduce function: (reduce fn coll) or
+// (reduce fn init coll). Without init, the first element is used instead.
+func Reduce(fn interface{}, args ...interface{}) interface{} {
+	var acc parser.Value
+	var coll interface{}
+	switch len(args) {
+	case 1:
+		coll = args[0]
+	case 2:
+		acc, coll = parser.NewAny(args[0], nil), args[1]
+	default:
+		panic("Function 'reduce' should take two or three arguments")
+	}
+
+	it := MustIterate(coll)
+	if acc == nil {
+		var ok bool
+		if acc, ok = it.Next(); !ok {
+			return Apply(fn).Value()
+		}
+	}
+	for v, ok := it.Next(); ok; v, ok = it.Next() {
+		acc = Apply(fn, acc, v)
+	}
+	return acc.Value()
+}
+
+// Range implements the range function: (range end), (range start end) or
+// (range start end step).
+func Range(args ...int64) []parser.Value {
+	return rangeValues(nil, args...)
+}
+
+// rangeValues is Range, charging ev for the list before building it.
+func rangeValues(ev *evaluation, args ...int64) []parser.Value {
+	var start, end, step int64 = 0, 0, 1
+	switch len(args) {
+	case 1:
+		end = args[0]
+	case 2:
+		start, end = args[0], args[1]
+	case 3:
+		start, end, step = args[0], args[1], args[2]
+	default:
+		panic("Function 'range' should take one to three arguments")
+	}
+	if step == 0 {
+		panic("Function 'range' step can not be 0")
+	}
+
+	// The differences are computed as unsigned integers, which can not
+	// overflow.
+	var n uint64
+	switch {
+	case step > 0 && start < end:
+		n = (uint64(end)-uint64(start)-1)/uint64(step) + 1
+	case step < 0 && start > end:
+		n = (uint64(start)-uint64(end)-1)/(-uint64(step)) + 1
+	}
+	if n > math.MaxInt64 {
+		n = math.MaxInt64
+	}
+	ev.allocValues(int64(n))
+
+	result := []parser.Value{}
+	for i := start; (step > 0 && i < end) || (step < 0 && i > end); i += step {
+		result = append(result, parser.NewAny(i, nil))
+	}
+	return result
+}
+
+// Take implements the take function, returning the first n elements of coll.
+// It stops reading coll once n elements were obtained.
+func Take(n int64, coll interface{}) []parser.Value {
+	return takeValues(nil, n, coll)
+}
+
+// takeValues is Take, charging ev for each element before adding it.
+func takeValues(ev *evaluation, n int64, coll interface{}) []parser.Value {
+	result := []parser.Value{}
+	it := MustIterate(coll)
+	for ; n > 0; n-- {
+		v, ok := it.Next()
+		if !ok {
+			break
+		}
+		ev.alloc(valueSize)
+		result = append(result, v)
+	}
+	return result
+}
+
+// Drop implements the drop function, returning all but the first n elements
+// of coll.
+func Drop(n int64, coll interface{}) interface{} {
+	if s, ok := coll.(*LazySeq); ok {
+		it := &seqIterator{s: s}
+		for ; n > 0; n-- {
+			if _, ok := it.Next(); !ok {
+				break
+			}
+		}
+		if it.s == nil {
+			return emptySeq()
+		}
+		return it.s
+	}
+	values := toValues(coll)
+	if n > int64(len(values)) {
+		n = int64(len(values))
+	}
+	if n < 0 {
+		n = 0
+	}
+	return append([]parser.Value{}, values[n:]...)
+}
+
+// Concat implements the concat function, returning a list with the elements
+// of all the collections.
+func Concat(colls ...interface{}) []parser.Value {
+	return concatValues(nil, colls...)
+}
+
+// concatValues is Concat, charging ev for each element before adding it.
+func concatValues(ev *evaluation, colls ...interface{}) []parser.Value {
+	result := []parser.Value{}
+	for _, coll := range colls {
+		if list, ok := coll.([]parser.Value); ok {
+			ev.allocValues(int64(len(list)))
+			result = append(result, list...)
+			continue
+		}
+		it := MustIterate(coll)
+		for v, ok := it.Next(); ok; v, ok = it.Next() {
+			ev.alloc(valueSize)
+			result = append(result, v)
+		}
+	}
+	return result
+}
+
+// Reverse implements the reverse function.
+func Reverse(coll interface{}) []parser.Value {
+	values := toValues(coll)
+	result := make([]parser.Value, len(values))
+	for i, v := range values {
+		result[len(values)-1-i] = v
+	}
+	return result
+}
+
+// Sort implements the sort function, returning the elements of coll in
+// increasing order, as defined by Compare.
+func Sort(coll interface{}) []parser.Value {
+	result := append([]parser.Value{}, toValues(coll)...)
+	sort.SliceStable(result, func(i, j int) bool {
+		return Compare(result[i].Value(), result[j].Value()) < 0
+	})
+	return result
+}
+
+// SortBy implements the sort-by function: (sort-by keyfn coll). Elements are
+// sorted according to the value of keyfn on each of them.
+func SortBy(keyfn interface{}, coll interface{}) []parser.Value {
+	values := toValues(coll)
+	keys := make(map[int]interface{}, len(values))
+	indexes := make([]int, len(values))
+	for i, v := range values {
+		indexes[i] = i
+		keys[i] = Apply(keyfn, v).Value()
+	}
+	sort.SliceStable(indexes, func(i, j int) bool {
+		return Compare(keys[indexes[i]], keys[indexes[j]]) < 0
+	})
+	result := make([]parser.Value, len(values))
+	for i, index := range indexes {
+		result[i] = values[index]
+	}
+	return result
+}
+
+// GroupBy implements the group-by function: (group-by fn coll). It returns a
+// map from the values of fn to the list of elements having that value.
+func GroupBy(fn interface{}, coll interface{}) map[interface{}]interface{} {
+	groups := map[interface{}]interface{}{}
+	it := MustIterate(coll)
+	for v, ok := it.Next(); ok; v, ok = it.Next() {
+		key := mapKey(Apply(fn, v).Value())
+		group, _ := groups[key].([]parser.Value)
+		groups[key] = append(group, v)
+	}
+	return groups
+}
+
+// Frequencies implements the frequencies function, returning a map from each
+// distinct element of coll to the number of times it appears.
+func Frequencies(coll interface{}) map[interface{}]interface{} {
+	counts := map[interface{}]interface{}{}
+	it := MustIterate(coll)
+	for v, ok := it.Next(); ok; v, ok = it.Next() {
+		key := mapKey(v.Value())
+		count, _ := counts[key].(int64)
+		counts[key] = count + 1
+	}
+	return counts
+}
+
+// mapKey checks that v can be used as a key in a Go map.
+func mapKey(v interface{}) interface{} {
+	if v != nil && !reflect.TypeOf(v).Comparable() {
+		panic(fmt.Sprintf("Values of type %T can not be used as map keys", v))
+	}
+	return v
+}
+
+// First implements the first function, returning the first element of coll or
+// nil if it is empty.
+func First(coll interface{}) interface{} {
+	v, ok := MustIterate(coll).Next()
+	if !ok {
+		return nil
+	}
+	return v.Value()
+}
+
+// Rest implements the rest function, returning all the elements of coll but
+// the first one.
+func Rest(coll interface{}) interface{} {
+	return Drop(1, coll)
+}
+
+// Cons implements the cons function, returning a list made of x followed by
+// the elements of coll. If coll is lazy, the result is a lazy sequence too.
+func Cons(x interface{}, coll interface{}) interface{} {
+	if s, ok := coll.(*LazySeq); ok {
+		return consSeq(parser.NewAny(x, nil), s)
+	}
+	return append([]parser.Value{parser.NewAny(x, nil)}, toValues(coll)...)
+}
+
+// Nth implements the nth function: (nth coll index) or
+// (nth coll index default). Without default, it panics when index is out of
+// bound.
+func Nth(coll interface{}, index int64, def ...interface{}) interface{} {
+	it := MustIterate(coll)
+	for i := int64(0); index >= 0; i++ {
+		v, ok := it.Next()
+		if !ok {
+			break
+		}
+		if i == index {
+			return v.Value()
+		}
+	}
+	if len(def) > 0 {
+		return def[0]
+	}
+	panic(fmt.Sprintf("Index %d out of bound", index))
+}
+
+// Some implements the some function: (some pred coll). It returns the first
+// true value of pred on the elements of coll, or nil.
+func Some(pred interface{}, coll interface{}) interface{} {
+	it := MustIterate(coll)
+	for v, ok := it.Next(); ok; v, ok = it.Next() {
+		if r := Apply(pred, v).Value(); Truthy(r) {
+			return r
+		}
+	}
+	return nil
+}
+
+// Every implements the every? function: (every? pred coll). It returns true
+// if pred is true for all the elements of coll.
+func Every(pred interface{}, coll interface{}) bool {
+	it := MustIterate(coll)
+	for v, ok := it.Next(); ok; v, ok = it.Next() {
+		if !Truthy(Apply(pred, v).Value()) {
+			return false
+		}
+	}
+	return true
+}
@@ -11,18 +11,28 @@ type StdLib interface {
 	LoadLib(ctx *Context, funcPrefix parser.Identifier)
 }
 
+// stdLibs are the libraries which can be imported, with the capabilities
+// they need: at least one of them must be allowed to import the library, and
+// each function checks its own.
+var stdLibs = map[string]struct {
+	lib          StdLib
+	capabilities Capability
+}{
+	"strings": {&StringsLib{}, CapPure},
+	"csv":     {&CSVLib{}, CapPure},
+	"bufio":   {&BufioLib{}, CapPure},
+	"os":      {&OSLib{}, CapFileRead | CapFileWrite | CapEnv | CapExec},
+	"time":    {&TimeLib{}, CapTime},
+	"http":    {&HTTPLib{}, CapNetwork},
+}
+
 func loadStdLib(name string, ctx *Context, funcPrefix parser.Identifier) {
-	var stdLib StdLib
-	switch name {
-	case "strings":
-		stdLib = &StringsLib{}
-		stdLib.LoadLib(ctx, funcPrefix)
-		return
-	case "csv":
-		stdLib = &CSVLib{}
-		stdLib.LoadLib(ctx, funcPrefix)
-		return
-	default:
+	stdLib, ok := stdLibs[name]
+	if !ok {
 		panic(fmt.Sprintf("package %s not found", name))
 	}
+	if stdLib.capabilities != CapPure && ctx.root().capabilities&stdLib.capabilities == 0 {
+		panic(capabilityError("package "+name, stdLib.capabilities))
+	}
+	stdLib.lib.LoadLib(ctx, funcPrefix)
 }
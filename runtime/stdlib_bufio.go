@@ -0,0 +1,20 @@
+package runtime
+
+import (
+	"bufio"
+
+	"github.com/rumlang/rum/parser"
+)
+
+// BufioLib struct
+type BufioLib struct{}
+
+// LoadLib function to BufioLib struct
+func (l *BufioLib) LoadLib(ctx *Context, funcPrefix parser.Identifier) {
+	if funcPrefix == "" {
+		funcPrefix = "bufio"
+	}
+	ctx.SetFn(ConcatIdentifier(funcPrefix, ".new-scanner"), bufio.NewScanner, CheckArity(1))
+	ctx.SetFn(ConcatIdentifier(funcPrefix, ".new-reader"), bufio.NewReader, CheckArity(1))
+	ctx.SetFn(ConcatIdentifier(funcPrefix, ".new-writer"), bufio.NewWriter, CheckArity(1))
+}
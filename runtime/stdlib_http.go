@@ -0,0 +1,39 @@
+package runtime
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/rumlang/rum/parser"
+)
+
+// HTTPLib gives access to the network.
+type HTTPLib struct{}
+
+// LoadLib function to HTTPLib struct
+func (l *HTTPLib) LoadLib(ctx *Context, funcPrefix parser.Identifier) {
+	if funcPrefix == "" {
+		funcPrefix = "http"
+	}
+	// get returns the body of the response to a GET request.
+	ctx.SetGuardedFn(ConcatIdentifier(funcPrefix, ".get"), CapNetwork, func(url string) string {
+		req, err := http.NewRequestWithContext(ctx.goContext(), http.MethodGet, url, nil)
+		if err != nil {
+			panic(err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			panic(err)
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			panic(err)
+		}
+		if resp.StatusCode >= 400 {
+			panic(fmt.Sprintf("GET %s: %s", url, resp.Status))
+		}
+		return string(body)
+	}, CheckArity(1))
+}
@@ -0,0 +1,43 @@
+package runtime
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+
+	"github.com/rumlang/rum/parser"
+)
+
+// OSLib gives access to the host: environment, files and processes.
+type OSLib struct{}
+
+// LoadLib function to OSLib struct
+func (l *OSLib) LoadLib(ctx *Context, funcPrefix parser.Identifier) {
+	if funcPrefix == "" {
+		funcPrefix = "os"
+	}
+	ctx.SetGuardedFn(ConcatIdentifier(funcPrefix, ".getenv"), CapEnv, os.Getenv, CheckArity(1))
+	ctx.SetGuardedFn(ConcatIdentifier(funcPrefix, ".read-file"), CapFileRead, func(path string) string {
+		ctx.RequirePath(CapFileRead, path)
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			panic(err)
+		}
+		return string(data)
+	}, CheckArity(1))
+	ctx.SetGuardedFn(ConcatIdentifier(funcPrefix, ".write-file"), CapFileWrite, func(path, content string) interface{} {
+		ctx.RequirePath(CapFileWrite, path)
+		if err := ioutil.WriteFile(path, []byte(content), 0666); err != nil {
+			panic(err)
+		}
+		return nil
+	}, CheckArity(2))
+	ctx.SetGuardedFn(ConcatIdentifier(funcPrefix, ".exec"), CapExec, func(name string, args ...string) string {
+		output, err := exec.CommandContext(ctx.goContext(), name, args...).CombinedOutput()
+		if err != nil {
+			panic(fmt.Sprintf("%s: %v: %s", name, err, output))
+		}
+		return string(output)
+	})
+}
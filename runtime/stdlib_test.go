@@ -2,6 +2,9 @@ package runtime
 
 import (
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"reflect"
 	"strings"
 	"testing"
@@ -66,3 +69,77 @@ func TestCSV(t *testing.T) {
 	checkSExprs(t, `(import strings
 		                    csv)`, valid)
 }
+
+func TestCapabilities(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	outside, err := ioutil.TempDir("", "rum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(outside)
+	if err := os.Symlink(outside, filepath.Join(dir, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	inside := filepath.Join(dir, "a.txt")
+	cases := []struct {
+		capabilities Capability
+		input        string
+		denied       bool
+	}{
+		{CapPure, "(+ 1 2)", false},
+		{CapPure, "(import strings)", false},
+		{CapPure, "(print 1)", true},
+		{CapPure, "(import os)", true},
+		{CapPure, "(import time)", true},
+		{CapEnv, "(begin (import os) (os.getenv \"HOME\"))", false},
+		{CapEnv, fmt.Sprintf("(begin (import os) (os.read-file %q))", inside), true},
+		{CapEnv, "(begin (import os) (os.exec \"true\"))", true},
+		{CapFileRead | CapFileWrite, fmt.Sprintf("(begin (import os) (os.write-file %q \"a\") (os.read-file %q))", inside, inside), false},
+		{CapFileRead, fmt.Sprintf("(begin (import os) (os.write-file %q \"a\"))", inside), true},
+		{CapFileWrite, fmt.Sprintf("(begin (import os) (os.write-file %q \"a\"))", filepath.Join(outside, "a.txt")), true},
+		{CapFileWrite, fmt.Sprintf("(begin (import os) (os.write-file %q \"a\"))", filepath.Join(dir, "..", "a.txt")), true},
+		{CapFileWrite, fmt.Sprintf("(begin (import os) (os.write-file %q \"a\"))", filepath.Join(dir, "link", "a.txt")), true},
+		{CapTime, "(begin (import time) (time.sleep 1) (time.now))", false},
+		{CapAll &^ CapNetwork, "(begin (import http) (http.get \"http://localhost\"))", true},
+	}
+
+	for _, tc := range cases {
+		c := NewContextWithOptions(Options{Capabilities: tc.capabilities, Roots: []string{dir}})
+		checkDenied(t, c, tc.input, tc.capabilities, tc.denied)
+	}
+
+	// The default context does not access the host, and no file is allowed
+	// without roots.
+	for _, input := range []string{
+		"(import os)",
+		"(import http)",
+		"(import time)",
+		fmt.Sprintf("(begin (import os) (os.read-file %q))", inside),
+	} {
+		checkDenied(t, NewContext(nil), input, CapDefault, true)
+	}
+	checkDenied(t, NewContext(nil), "(begin (import strings) (print \"\"))", CapDefault, false)
+	c := NewContextWithOptions(Options{Capabilities: CapFileRead | CapFileWrite})
+	checkDenied(t, c, fmt.Sprintf("(begin (import os) (os.write-file %q \"a\"))", inside), CapFileRead|CapFileWrite, true)
+}
+
+func checkDenied(t *testing.T, c *Context, input string, capabilities Capability, expected bool) {
+	p, err := parser.Parse(parser.NewSource(input))
+	if err != nil {
+		t.Fatalf("Unable to parse %q: %v", input, err)
+	}
+	_, err = c.TryEval(p)
+	e, _ := err.(*Error)
+	if denied := e != nil && e.Code == ErrCapability; denied != expected {
+		t.Errorf("Input %q with %s - expected denied: %v, got: %v", input, capabilities, expected, err)
+		return
+	}
+	if !expected && err != nil {
+		t.Errorf("Input %q with %s - unexpected error: %v", input, capabilities, err)
+	}
+}
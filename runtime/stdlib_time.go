@@ -0,0 +1,33 @@
+package runtime
+
+import (
+	"time"
+
+	"github.com/rumlang/rum/parser"
+)
+
+// TimeLib gives access to the clock.
+type TimeLib struct{}
+
+// LoadLib function to TimeLib struct
+func (l *TimeLib) LoadLib(ctx *Context, funcPrefix parser.Identifier) {
+	if funcPrefix == "" {
+		funcPrefix = "time"
+	}
+	ctx.SetGuardedFn(ConcatIdentifier(funcPrefix, ".now"), CapTime, time.Now, CheckArity(0))
+	ctx.SetGuardedFn(ConcatIdentifier(funcPrefix, ".since"), CapTime, func(t time.Time) int64 {
+		return int64(time.Since(t) / time.Millisecond)
+	}, CheckArity(1))
+	// sleep takes a number of milliseconds, and is interrupted when the
+	// evaluation is stopped.
+	ctx.SetGuardedFn(ConcatIdentifier(funcPrefix, ".sleep"), CapTime, func(ms int64) interface{} {
+		timer := time.NewTimer(time.Duration(ms) * time.Millisecond)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+			return nil
+		case <-ctx.goContext().Done():
+			panic(ctx.root().current().stopped())
+		}
+	}, CheckArity(1))
+}
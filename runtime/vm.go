@@ -0,0 +1,403 @@
+package runtime
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/rumlang/rum/parser"
+)
+
+// opcode is an instruction of the virtual machine. The arguments a and b of
+// the instruction are described for each opcode.
+type opcode uint8
+
+const (
+	// opConst pushes the constant a.
+	opConst opcode = iota
+	// opLocal pushes the local slot a.
+	opLocal
+	// opFree pushes the captured value a of the closure.
+	opFree
+	// opGlobal pushes the variable named a, looked up in the context.
+	opGlobal
+	// opStore pops a value into the local slot a.
+	opStore
+	// opDefine defines the variable named a in the context with the value on
+	// top of the stack, which is kept. b is 1 for strict definitions (let).
+	opDefine
+	// opPop drops the value on top of the stack.
+	opPop
+	// opJump continues at pc a.
+	opJump
+	// opJumpFalse pops a value and continues at pc a if it is false.
+	opJumpFalse
+	// opJumpTrue pops a value and continues at pc a if it is true.
+	opJumpTrue
+	// opAndJump continues at pc a, keeping the value on top of the stack, if
+	// it is false. Otherwise, the value is dropped.
+	opAndJump
+	// opOrJump continues at pc a, keeping the value on top of the stack, if it
+	// is true. Otherwise, the value is dropped.
+	opOrJump
+	// opCall pops a arguments and the function below them, and pushes the
+	// result of the call.
+	opCall
+	// opTailCall is similar to opCall, but replaces the current frame when
+	// calling a closure.
+	opTailCall
+	// opBuiltin pops b arguments and pushes the result of the builtin a.
+	opBuiltin
+	// opClosure pushes a closure of the function a, capturing its free
+	// variables.
+	opClosure
+	// opEval pushes the result of the interpreter on the constant a.
+	opEval
+	// opReturn returns the value on top of the stack.
+	opReturn
+)
+
+// instr is a single instruction.
+type instr struct {
+	op   opcode
+	a, b int32
+}
+
+// proto is the compiled code of a function or of a top-level expression.
+type proto struct {
+	name string
+	code []instr
+	// sources[pc] is the expression instruction pc was compiled from, used to
+	// report errors; nil when the error already contains it.
+	sources []parser.Value
+	consts  []parser.Value
+	names   []parser.Symbol
+	protos  []*proto
+	// params is the number of positional parameters, bound to the first
+	// slots, followed by the rest parameter if rest is true.
+	params int
+	rest   bool
+	// locals is the number of local slots, parameters included.
+	locals   int
+	captures []capture
+}
+
+// capture describes where a closure finds one of its free variables when it
+// is created: a local slot or a free variable of the enclosing closure.
+type capture struct {
+	local bool
+	index int
+}
+
+// Closure is a function compiled to bytecode, with the values of its free
+// variables.
+type Closure struct {
+	proto *proto
+	ctx   *Context
+	free  []parser.Value
+}
+
+func (f *Closure) String() string {
+	if f.proto.name == "" {
+		return "<lambda>"
+	}
+	return fmt.Sprintf("<function %s>", f.proto.name)
+}
+
+// Apply calls the closure with the provided evaluated arguments.
+func (f *Closure) Apply(args ...parser.Value) parser.Value {
+	return resolve(f.call(args, nil))
+}
+
+func (f *Closure) call(args []parser.Value, ref *parser.SourceRef) parser.Value {
+	return run(f, f.bind(args, ref))
+}
+
+// bind returns the local slots of a call to the closure with args.
+func (f *Closure) bind(args []parser.Value, ref *parser.SourceRef) []parser.Value {
+	p := f.proto
+	if len(args) < p.params || (!p.rest && len(args) > p.params) {
+		name := p.name
+		if name == "" {
+			name = "lambda"
+		}
+		expected := fmt.Sprint(p.params)
+		if p.rest {
+			expected = "at least " + expected
+		}
+		msg := fmt.Sprintf("%s expects %s arguments, got %d", name, expected, len(args))
+		if ref != nil {
+			msg += fmt.Sprintf(" (called at line %d, col %d)", ref.Line+1, ref.Column+1)
+		}
+		panic(&Error{
+			Code: ErrArity,
+			Msg:  msg,
+		})
+	}
+
+	locals := make([]parser.Value, p.locals)
+	copy(locals, args[:p.params])
+	if p.rest {
+		locals[p.params] = parser.NewAny(append([]parser.Value{}, args[p.params:]...), nil)
+	}
+	return locals
+}
+
+// Program is an expression compiled to bytecode by Compile.
+type Program struct {
+	main *Closure
+}
+
+// Run checks the program and executes it. It catches any panic, returning an
+// error instead.
+func (p *Program) Run() (parser.Value, error) {
+	return p.RunContext(context.Background())
+}
+
+// RunContext is similar to Run, but the execution is also stopped when ctx is
+// done, like with TryEvalContext.
+func (p *Program) RunContext(ctx context.Context) (result parser.Value, err error) {
+	if err := p.Check(); err != nil {
+		return nil, err
+	}
+	end := p.main.ctx.root().begin(ctx)
+	defer end()
+	defer func() {
+		if r := recover(); r != nil {
+			err = vmError(p.main.ctx, r, nil)
+		}
+	}()
+	return run(p.main, make([]parser.Value, p.main.proto.locals)), nil
+}
+
+// vmError converts a recovered panic to an *Error, adding source to its
+// stack.
+func vmError(ctx *Context, r interface{}, source parser.Value) *Error {
+	err := ctx.recovered(r)
+	if source != nil {
+		err.Stack = append(err.Stack, source)
+	}
+	return err
+}
+
+// callValue calls fn with evaluated arguments from compiled code.
+func callValue(fn parser.Value, args []parser.Value, ref *parser.SourceRef) parser.Value {
+	if _, ok := fn.Value().(Internal); ok {
+		panic("Special forms can not be used as functions")
+	}
+	return resolve(call(fn, args, ref))
+}
+
+// run executes the closure f with the provided local slots. Tail calls to
+// other closures reuse the same Go frame.
+func run(f *Closure, locals []parser.Value) parser.Value {
+	p := f.proto
+	pc := 0
+	ev := f.ctx.root().current()
+	if err := ev.enter(); err != nil {
+		panic(err)
+	}
+	// The local slots are the bindings of the scope of the call, charged
+	// like the bindings of the interpreter while it runs.
+	bound := int64(len(locals)) * bindingSize
+	defer func() {
+		ev.free(bound)
+		ev.leave()
+		if r := recover(); r != nil {
+			panic(vmError(f.ctx, r, p.sources[pc]))
+		}
+	}()
+	ev.alloc(bound)
+
+	stack := make([]parser.Value, 0, 8)
+	for {
+		in := p.code[pc]
+		switch in.op {
+		case opConst:
+			stack = append(stack, p.consts[in.a])
+		case opLocal:
+			stack = append(stack, locals[in.a])
+		case opFree:
+			stack = append(stack, f.free[in.a])
+		case opGlobal:
+			stack = append(stack, f.ctx.get(p.names[in.a]))
+		case opStore:
+			locals[in.a] = stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+		case opDefine:
+			f.ctx.define(p.names[in.a], stack[len(stack)-1], in.b == 1)
+		case opPop:
+			stack = stack[:len(stack)-1]
+		case opJump:
+			if int(in.a) <= pc {
+				// Loops are counted as steps.
+				if err := ev.step(); err != nil {
+					panic(err)
+				}
+			}
+			pc = int(in.a)
+			continue
+		case opJumpFalse, opJumpTrue:
+			v := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			if Truthy(v.Value()) == (in.op == opJumpTrue) {
+				pc = int(in.a)
+				continue
+			}
+		case opAndJump, opOrJump:
+			if Truthy(stack[len(stack)-1].Value()) == (in.op == opOrJump) {
+				pc = int(in.a)
+				continue
+			}
+			stack = stack[:len(stack)-1]
+		case opCall, opTailCall:
+			if err := ev.step(); err != nil {
+				panic(err)
+			}
+			n := int(in.a)
+			fn := stack[len(stack)-n-1]
+			args := make([]parser.Value, n)
+			copy(args, stack[len(stack)-n:])
+			stack = stack[:len(stack)-n-1]
+			ref := p.sources[pc].Ref()
+			if g, ok := fn.Value().(*Closure); ok && in.op == opTailCall {
+				locals = g.bind(args, ref)
+				ev.free(bound)
+				bound = int64(len(locals)) * bindingSize
+				ev.alloc(bound)
+				f, p, pc = g, g.proto, 0
+				stack = stack[:0]
+				continue
+			}
+			v := callValue(fn, args, ref)
+			if _, ok := fn.Value().(callable); !ok {
+				// Rum functions and accounted builtins account for their own
+				// allocations.
+				ev.allocValue(v)
+			}
+			stack = append(stack, v)
+		case opBuiltin:
+			n := int(in.b)
+			args := stack[len(stack)-n:]
+			b := builtins[in.a]
+			v, ok := b.fast(args)
+			if !ok {
+				v = callValue(parser.NewAny(b.fn, nil), append([]parser.Value{}, args...), p.sources[pc].Ref())
+			}
+			ev.allocValue(v)
+			stack = append(stack[:len(stack)-n], v)
+		case opClosure:
+			child := p.protos[in.a]
+			free := make([]parser.Value, len(child.captures))
+			for i, c := range child.captures {
+				if c.local {
+					free[i] = locals[c.index]
+				} else {
+					free[i] = f.free[c.index]
+				}
+			}
+			stack = append(stack, parser.NewAny(&Closure{proto: child, ctx: f.ctx, free: free}, nil))
+		case opEval:
+			stack = append(stack, f.ctx.MustEval(p.consts[in.a]))
+		case opReturn:
+			return stack[len(stack)-1]
+		}
+		pc++
+	}
+}
+
+// builtin is a function of the default context which compiled code calls
+// directly. fast handles the common argument types without reflection, and
+// reports false for the others, which are passed to fn.
+type builtin struct {
+	name parser.Identifier
+	fn   interface{}
+	fast func(args []parser.Value) (parser.Value, bool)
+}
+
+var builtins = []builtin{
+	{"+", OpAdd, fastArith(1, func(a, b int64) int64 { return a + b })},
+	{"-", OpSub, fastArith(2, func(a, b int64) int64 { return a - b })},
+	{"*", OpMul, fastArith(1, func(a, b int64) int64 { return a * b })},
+	{"<", OpLess, fastCompare(func(a, b int64) bool { return a < b })},
+	{"<=", OpLessEqual, fastCompare(func(a, b int64) bool { return a <= b })},
+	{">", OpGreater, fastCompare(func(a, b int64) bool { return a > b })},
+	{">=", OpGreaterEqual, fastCompare(func(a, b int64) bool { return a >= b })},
+	{"==", OpEqual, fastEqual},
+	{"!=", OpNotEqual, fastCompare(func(a, b int64) bool { return a != b })},
+	{"not", Not, fastNot},
+	{"list", List, fastList},
+}
+
+// fastArith folds integer arguments with op, when there are at least min of
+// them.
+func fastArith(min int, op func(a, b int64) int64) func([]parser.Value) (parser.Value, bool) {
+	return func(args []parser.Value) (parser.Value, bool) {
+		if len(args) < min {
+			return nil, false
+		}
+		total, ok := args[0].Value().(int64)
+		if !ok {
+			return nil, false
+		}
+		for _, arg := range args[1:] {
+			v, ok := arg.Value().(int64)
+			if !ok {
+				return nil, false
+			}
+			total = op(total, v)
+		}
+		return parser.NewAny(total, nil), true
+	}
+}
+
+// fastCompare compares two integer arguments with op.
+func fastCompare(op func(a, b int64) bool) func([]parser.Value) (parser.Value, bool) {
+	return func(args []parser.Value) (parser.Value, bool) {
+		if len(args) != 2 {
+			return nil, false
+		}
+		a, ok := args[0].Value().(int64)
+		if !ok {
+			return nil, false
+		}
+		b, ok := args[1].Value().(int64)
+		if !ok {
+			return nil, false
+		}
+		return parser.NewAny(op(a, b), nil), true
+	}
+}
+
+func fastEqual(args []parser.Value) (parser.Value, bool) {
+	if len(args) < 2 {
+		return nil, false
+	}
+	ref, ok := args[0].Value().(int64)
+	if !ok {
+		return nil, false
+	}
+	equal := true
+	for _, arg := range args[1:] {
+		v, ok := arg.Value().(int64)
+		if !ok {
+			return nil, false
+		}
+		equal = equal && v == ref
+	}
+	return parser.NewAny(equal, nil), true
+}
+
+func fastNot(args []parser.Value) (parser.Value, bool) {
+	if len(args) != 1 {
+		return nil, false
+	}
+	return parser.NewAny(!Truthy(args[0].Value()), nil), true
+}
+
+func fastList(args []parser.Value) (parser.Value, bool) {
+	list := make([]parser.Value, len(args))
+	for i, arg := range args {
+		list[i] = parser.NewAny(arg.Value(), nil)
+	}
+	return parser.NewAny(list, nil), true
+}